@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// APIFeed is the JSON representation of a feed in the admin API
+type APIFeed struct {
+	Name     string     `json:"name"`
+	URL      string     `json:"url"`
+	Nick     string     `json:"nick,omitempty"`
+	Template string     `json:"template,omitempty"`
+	Avatar   string     `json:"avatar,omitempty"`
+	Disabled bool       `json:"disabled"`
+	Pending  bool       `json:"pending,omitempty"`
+	TwtxtURL string     `json:"twtxt_url"`
+	Twts     int        `json:"twts"`
+	LastTwt  *time.Time `json:"last_twt,omitempty"`
+
+	Health *APIHealth `json:"health,omitempty"`
+}
+
+// APIHealth is the JSON representation of a feed's health
+type APIHealth struct {
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastErrorAt  *time.Time `json:"last_error_at,omitempty"`
+	LastStatus   int        `json:"last_status,omitempty"`
+	Failures     int        `json:"failures"`
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+	ItemsEmitted int        `json:"items_emitted"`
+	NextPoll     *time.Time `json:"next_poll,omitempty"`
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// APIFeedRequest is the JSON body accepted when creating or patching a feed.
+// Fields that are omitted are left unchanged when patching.
+type APIFeedRequest struct {
+	Name     *string `json:"name"`
+	URL      *string `json:"url"`
+	Nick     *string `json:"nick"`
+	Template *string `json:"template"`
+	Avatar   *string `json:"avatar"`
+	Disabled *bool   `json:"disabled"`
+}
+
+func (app *App) newAPIFeed(name string, feed FeedConfig) APIFeed {
+	apiFeed := APIFeed{
+		Name:     name,
+		URL:      feed.URL,
+		Nick:     feed.Nick,
+		Template: feed.Template,
+		Avatar:   feed.Avatar,
+		Disabled: feed.Disabled,
+		TwtxtURL: URLForFeed(app.conf, name),
+		Health:   app.newAPIHealth(name),
+	}
+
+	if stats, ok := app.conf.Index().Get(name); ok {
+		apiFeed.Twts = stats.Twts
+		apiFeed.LastTwt = timeOrNil(stats.LastTwt)
+	}
+
+	return apiFeed
+}
+
+func (app *App) newAPIHealth(name string) *APIHealth {
+	state, err := LoadState(app.conf, name)
+	if err != nil {
+		log.WithError(err).Warnf("error loading state for %s", name)
+		return nil
+	}
+
+	health := state.Health
+	return &APIHealth{
+		LastSuccess:  timeOrNil(health.LastSuccess),
+		LastError:    health.LastError,
+		LastErrorAt:  timeOrNil(health.LastErrorAt),
+		LastStatus:   health.LastStatus,
+		Failures:     health.Failures,
+		FailingSince: timeOrNil(health.FailingSince),
+		ItemsEmitted: health.ItemsEmitted,
+		NextPoll:     timeOrNil(state.NextPoll),
+	}
+}
+
+func renderJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("error encoding json response")
+	}
+}
+
+func renderJSONError(w http.ResponseWriter, status int, msg string) {
+	renderJSON(w, status, map[string]string{"error": msg})
+}
+
+// applyFeedRequest validates and applies the fields of req to feed
+func applyFeedRequest(req APIFeedRequest, feed *FeedConfig) error {
+	if req.Nick != nil {
+		if err := ValidateNick(*req.Nick); err != nil {
+			return fmt.Errorf("invalid nick: %w", err)
+		}
+		feed.Nick = *req.Nick
+	}
+	if req.Template != nil {
+		if _, err := ParseTwtTemplate("feed", *req.Template); err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+		feed.Template = *req.Template
+	}
+	if req.Avatar != nil {
+		feed.Avatar = *req.Avatar
+	}
+	if req.Disabled != nil {
+		feed.Disabled = *req.Disabled
+	}
+	return nil
+}
+
+func (app *App) APIListFeedsHandler(w http.ResponseWriter, r *http.Request) {
+	feeds := []APIFeed{}
+	for name, feed := range app.conf.AllFeeds() {
+		feeds = append(feeds, app.newAPIFeed(name, feed))
+	}
+	sort.Slice(feeds, func(i, j int) bool { return feeds[i].Name < feeds[j].Name })
+
+	renderJSON(w, http.StatusOK, feeds)
+}
+
+func (app *App) APIGetFeedHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	feed, ok := app.conf.GetFeed(name)
+	if !ok {
+		renderJSONError(w, http.StatusNotFound, "feed not found")
+		return
+	}
+
+	renderJSON(w, http.StatusOK, app.newAPIFeed(name, feed))
+}
+
+func (app *App) APICreateFeedHandler(w http.ResponseWriter, r *http.Request) {
+	var req APIFeedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		renderJSONError(w, http.StatusBadRequest, "invalid json body")
+		return
+	}
+
+	if req.URL == nil || *req.URL == "" {
+		renderJSONError(w, http.StatusBadRequest, "missing url")
+		return
+	}
+
+	feed, err := ValidateFeed(app.conf, *req.URL)
+	if multiple, ok := err.(*MultipleFeedsError); ok {
+		renderJSON(w, http.StatusMultipleChoices, map[string]interface{}{
+			"error":      "multiple feeds found, choose one of the candidates",
+			"candidates": multiple.Candidates,
+		})
+		return
+	}
+	if err != nil {
+		renderJSONError(w, http.StatusBadRequest, fmt.Sprintf("no valid RSS, Atom or JSON feed found: %s", *req.URL))
+		return
+	}
+
+	name := feed.Name
+	if req.Name != nil && *req.Name != "" {
+		name = *req.Name
+	}
+	if !validName.MatchString(name) {
+		renderJSONError(w, http.StatusBadRequest, ErrInvalidName.Error())
+		return
+	}
+
+	feedConf := FeedConfig{URL: feed.URL}
+	if err := applyFeedRequest(req, &feedConf); err != nil {
+		renderJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	pending := app.needsModeration(r)
+	if pending {
+		err = app.conf.AddPending(name, feedConf)
+	} else {
+		err = app.conf.AddFeed(name, feedConf)
+	}
+	if err == ErrFeedExists {
+		renderJSONError(w, http.StatusConflict, "feed already exists")
+		return
+	}
+
+	if err := app.conf.Save(); err != nil {
+		log.WithError(err).Error("error saving config")
+		renderJSONError(w, http.StatusInternalServerError, "error saving feed")
+		return
+	}
+
+	apiFeed := app.newAPIFeed(name, feedConf)
+	if pending {
+		apiFeed.Pending = true
+		renderJSON(w, http.StatusAccepted, apiFeed)
+		return
+	}
+
+	renderJSON(w, http.StatusCreated, apiFeed)
+}
+
+func (app *App) APIPatchFeedHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req APIFeedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		renderJSONError(w, http.StatusBadRequest, "invalid json body")
+		return
+	}
+
+	if req.Name != nil && *req.Name != name {
+		renderJSONError(w, http.StatusBadRequest, "feed name cannot be changed, use rename")
+		return
+	}
+
+	current, ok := app.conf.GetFeed(name)
+	if !ok {
+		renderJSONError(w, http.StatusNotFound, "feed not found")
+		return
+	}
+
+	if req.URL != nil && *req.URL != current.URL {
+		if _, err := TestFeed(app.conf, *req.URL); err != nil {
+			renderJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid feed url: %s", *req.URL))
+			return
+		}
+	}
+
+	enabled := false
+	feedConf, err := app.conf.ModifyFeed(name, func(feed *FeedConfig) error {
+		wasDisabled := feed.Disabled
+		if req.URL != nil {
+			feed.URL = *req.URL
+		}
+		if err := applyFeedRequest(req, feed); err != nil {
+			return err
+		}
+		enabled = wasDisabled && !feed.Disabled
+		return nil
+	})
+	if err == ErrFeedNotFound {
+		renderJSONError(w, http.StatusNotFound, "feed not found")
+		return
+	}
+	if err != nil {
+		renderJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := app.conf.Save(); err != nil {
+		log.WithError(err).Error("error saving config")
+		renderJSONError(w, http.StatusInternalServerError, "error saving feed")
+		return
+	}
+
+	if enabled {
+		if err := ResetHealth(app.conf, name); err != nil {
+			log.WithError(err).Warnf("error resetting health of %s", name)
+		}
+		log.Infof("re-enabled feed %s", name)
+	}
+
+	renderJSON(w, http.StatusOK, app.newAPIFeed(name, feedConf))
+}
+
+func (app *App) APIDeleteFeedHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var opts DeleteOptions
+	for param, opt := range map[string]*bool{
+		"keep_archives": &opts.KeepArchives,
+		"tombstone":     &opts.Tombstone,
+	} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			renderJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s parameter", param))
+			return
+		}
+		*opt = b
+	}
+
+	feed, err := DeleteFeed(app.conf, name, opts, time.Now())
+	if err == ErrFeedNotFound {
+		renderJSONError(w, http.StatusNotFound, "feed not found")
+		return
+	}
+	if err == ErrArchivesWithoutTombstone {
+		renderJSONError(w, http.StatusBadRequest, "keep_archives requires tombstone")
+		return
+	}
+	if err != nil {
+		log.WithError(err).Errorf("error deleting feed %s", name)
+		renderJSONError(w, http.StatusInternalServerError, "error deleting feed")
+		return
+	}
+
+	log.Infof("deleted feed %s: %s", name, feed.URL)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *App) APIPauseFeedHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	name := vars["name"]
+
+	var (
+		feed FeedConfig
+		err  error
+	)
+	action := vars["action"]
+	if action == "pause" {
+		feed, err = PauseFeed(app.conf, name)
+	} else {
+		feed, err = ResumeFeed(app.conf, name)
+	}
+	if err != nil {
+		renderJSONError(w, http.StatusNotFound, "feed not found")
+		return
+	}
+
+	if err := app.conf.Save(); err != nil {
+		log.WithError(err).Error("error saving config")
+		renderJSONError(w, http.StatusInternalServerError, "error saving feed")
+		return
+	}
+
+	log.Infof("%s feed %s", action, name)
+
+	renderJSON(w, http.StatusOK, app.newAPIFeed(name, feed))
+}
+
+func (app *App) APIRenameFeedHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req APIFeedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		renderJSONError(w, http.StatusBadRequest, "invalid json body")
+		return
+	}
+
+	if req.Name == nil || *req.Name == "" {
+		renderJSONError(w, http.StatusBadRequest, "missing name")
+		return
+	}
+	to := *req.Name
+
+	feed, err := RenameFeed(app.conf, name, to)
+	switch err {
+	case nil:
+	case ErrFeedNotFound:
+		renderJSONError(w, http.StatusNotFound, "feed not found")
+		return
+	case ErrFeedExists:
+		renderJSONError(w, http.StatusConflict, "feed already exists")
+		return
+	case ErrInvalidName:
+		renderJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	default:
+		if _, ok := app.conf.GetFeed(to); !ok {
+			log.WithError(err).Errorf("error renaming feed %s to %s", name, to)
+			renderJSONError(w, http.StatusInternalServerError, "error renaming feed")
+			return
+		}
+		// The feed was renamed but some of its files couldn't be moved
+		log.WithError(err).Errorf("error moving files of feed %s to %s", name, to)
+	}
+
+	if err := app.conf.Save(); err != nil {
+		log.WithError(err).Error("error saving config")
+		renderJSONError(w, http.StatusInternalServerError, "error saving feed")
+		return
+	}
+
+	renderJSON(w, http.StatusOK, app.newAPIFeed(to, feed))
+}
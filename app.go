@@ -1,10 +1,14 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"net/http"
 	"os"
+	"os/signal"
 	"sort"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -13,11 +17,20 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// shutdownTimeout is how long to wait for requests and background jobs
+	// to finish when shutting down
+	shutdownTimeout = time.Second * 30
+)
+
 type App struct {
 	bind   string
 	conf   *Config
 	cron   *cron.Cron
 	router *mux.Router
+	jobs   *jobTracker
+
+	encoded *encodingCache // compressed feeds served by FeedHandler
 }
 
 func NewApp(bind, config string) (*App, error) {
@@ -26,24 +39,46 @@ func NewApp(bind, config string) (*App, error) {
 		return nil, err
 	}
 
+	// Index the generated feeds served by the listings
+	conf.Index().Build(conf)
+
 	cron := cron.New()
 
 	return &App{
 		bind: bind,
 		conf: conf,
 		cron: cron,
+		jobs: &jobTracker{},
+
+		encoded: newEncodingCache(),
 	}, nil
 }
 
 func (app *App) initRoutes() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 
-	router.HandleFunc("/", app.IndexHandler).Methods(http.MethodGet, http.MethodHead, http.MethodPost)
+	router.Use(app.AuthMiddleware)
+
+	router.HandleFunc("/", app.IndexHandler).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/", app.RequireSubmitter(app.IndexHandler)).Methods(http.MethodPost)
 	router.HandleFunc("/feeds", app.FeedsHandler).Methods(http.MethodGet, http.MethodHead)
 	router.HandleFunc("/we-are-feeds.txt", app.WeAreFeedsHandler).Methods(http.MethodGet, http.MethodHead)
 	router.HandleFunc("/{name}/twtxt.txt", app.FeedHandler).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/{name}/twtxt.txt.{n:[0-9]+}", app.ArchiveHandler).Methods(http.MethodGet, http.MethodHead)
 	router.HandleFunc("/{name}/avatar.png", app.AvatarHandler).Methods(http.MethodGet, http.MethodHead)
 
+	router.HandleFunc("/admin/pending", app.RequireRole(RoleAdmin, app.PendingHandler)).Methods(http.MethodGet)
+	router.HandleFunc("/admin/pending/{name}/{action:approve|reject}", app.RequireRole(RoleAdmin, app.ModerateHandler)).Methods(http.MethodPost)
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/feeds", app.RequireRole(RoleSubmitter, app.APIListFeedsHandler)).Methods(http.MethodGet)
+	api.HandleFunc("/feeds", app.RequireRole(RoleSubmitter, app.APICreateFeedHandler)).Methods(http.MethodPost)
+	api.HandleFunc("/feeds/{name}", app.RequireRole(RoleSubmitter, app.APIGetFeedHandler)).Methods(http.MethodGet)
+	api.HandleFunc("/feeds/{name}", app.RequireRole(RoleAdmin, app.APIPatchFeedHandler)).Methods(http.MethodPatch)
+	api.HandleFunc("/feeds/{name}", app.RequireRole(RoleAdmin, app.APIDeleteFeedHandler)).Methods(http.MethodDelete)
+	api.HandleFunc("/feeds/{name}/{action:pause|resume}", app.RequireRole(RoleAdmin, app.APIPauseFeedHandler)).Methods(http.MethodPost)
+	api.HandleFunc("/feeds/{name}/rename", app.RequireRole(RoleAdmin, app.APIRenameFeedHandler)).Methods(http.MethodPost)
+
 	return router
 }
 
@@ -53,7 +88,7 @@ func (app *App) setupCronJobs() error {
 			continue
 		}
 
-		job := jobSpec.Factory(app.conf)
+		job := app.jobs.Track(jobSpec.Factory(app.conf))
 		if err := app.cron.AddJob(jobSpec.Schedule, job); err != nil {
 			return err
 		}
@@ -64,35 +99,39 @@ func (app *App) setupCronJobs() error {
 }
 
 func (app *App) runStartupJobs() {
-	time.Sleep(time.Second * 5)
+	select {
+	case <-time.After(time.Second * 5):
+	case <-app.conf.done:
+		return
+	}
 
 	log.Info("running startup jobs")
 	for name, jobSpec := range StartupJobs {
-		job := jobSpec.Factory(app.conf)
+		if app.conf.ShuttingDown() {
+			return
+		}
+		job := app.jobs.Track(jobSpec.Factory(app.conf))
 		log.Infof("running %s now...", name)
 		job.Run()
 	}
 }
 
 func (app *App) GetFeeds() (feeds []Feed) {
-	files, err := WalkMatch(app.conf.Root, "*.txt")
-	if err != nil {
-		log.WithError(err).Error("error reading feeds directory")
-		return nil
-	}
-
-	for _, filename := range files {
-		name := BaseWithoutExt(filename)
-
-		stat, err := os.Stat(filename)
-		if err != nil {
-			log.WithError(err).Warnf("error getting feed stats for %s", name)
+	for name, feedConf := range app.conf.AllFeeds() {
+		stats, ok := app.conf.Index().Get(name)
+		if !ok {
+			// Not generated yet
 			continue
 		}
-		lastModified := humanize.Time(stat.ModTime())
 
-		url := fmt.Sprintf("%s/%s/twtxt.txt", app.conf.BaseURL, name)
-		feeds = append(feeds, Feed{name, url, lastModified})
+		feeds = append(feeds, Feed{
+			Name:         name,
+			URL:          URLForFeed(app.conf, name),
+			LastModified: humanize.Time(stats.ModTime),
+			Twts:         stats.Twts,
+			Disabled:     feedConf.Disabled,
+			Failures:     stats.Failures,
+		})
 	}
 
 	sort.Slice(feeds, func(i, j int) bool { return feeds[i].Name < feeds[j].Name })
@@ -101,6 +140,14 @@ func (app *App) GetFeeds() (feeds []Feed) {
 }
 
 func (app *App) Run() error {
+	// Lets the cli find the server to tell it to reload the config
+	unlock, err := lockServer(app.conf.PIDFile())
+	if err != nil {
+		log.WithError(err).Error("error locking config for server mode")
+		return err
+	}
+	defer unlock()
+
 	router := app.initRoutes()
 
 	if err := app.setupCronJobs(); err != nil {
@@ -114,5 +161,97 @@ func (app *App) Run() error {
 
 	go app.runStartupJobs()
 
-	return http.ListenAndServe(app.bind, router)
+	if err := app.handleReloads(); err != nil {
+		log.WithError(err).Error("error setting up config reloading")
+		return err
+	}
+
+	server := &http.Server{Addr: app.bind, Handler: router}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Infof("received %s, shutting down", sig)
+	}
+
+	return app.Shutdown(server)
+}
+
+// Shutdown stops accepting requests and waits for in-flight requests and
+// running background jobs to finish, up to shutdownTimeout. Jobs stop after
+// the feed they are updating so that no feed or state file is left
+// partially written.
+func (app *App) Shutdown(server *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithError(err).Error("error waiting for requests to finish")
+	}
+
+	app.cron.Stop()
+	app.conf.Shutdown()
+
+	if err := app.jobs.Wait(ctx); err != nil {
+		log.WithError(err).Error("error waiting for background jobs to finish")
+		return err
+	}
+
+	log.Info("shut down")
+	return nil
+}
+
+// jobTracker keeps track of running background jobs so that shutting down
+// can wait for them
+type jobTracker struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+// Track returns job wrapped so that its runs are tracked. Runs starting
+// after .Wait() was called are skipped.
+func (tracker *jobTracker) Track(job cron.Job) cron.Job {
+	return cron.FuncJob(func() {
+		tracker.mu.Lock()
+		if tracker.stopped {
+			tracker.mu.Unlock()
+			return
+		}
+		tracker.wg.Add(1)
+		tracker.mu.Unlock()
+
+		defer tracker.wg.Done()
+		job.Run()
+	})
+}
+
+// Wait waits for running jobs to finish or ctx to be done
+func (tracker *jobTracker) Wait(ctx context.Context) error {
+	tracker.mu.Lock()
+	tracker.stopped = true
+	tracker.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		tracker.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("error: timed out waiting for background jobs")
+	}
 }
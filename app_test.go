@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+func TestJobTrackerWait(t *testing.T) {
+	tracker := &jobTracker{}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	runs := 0
+	job := tracker.Track(cron.FuncJob(func() {
+		runs++
+		close(started)
+		<-release
+	}))
+
+	go job.Run()
+	<-started
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- tracker.Wait(context.Background())
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while a job was running")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	close(release)
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Wait did not return after the job finished")
+	}
+
+	// Runs starting after Wait are skipped
+	job.Run()
+	if runs != 1 {
+		t.Errorf("job ran %d times, want 1", runs)
+	}
+}
+
+func TestJobTrackerWaitTimeout(t *testing.T) {
+	tracker := &jobTracker{}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	job := tracker.Track(cron.FuncJob(func() {
+		close(started)
+		<-release
+	}))
+	go job.Run()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if err := tracker.Wait(ctx); err == nil {
+		t.Error("Wait returned no error for a job running past the timeout")
+	}
+}
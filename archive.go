@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	twtHashLength = 7
+)
+
+// TwtHash returns the hash identifying a twt of the feed at url, as used by
+// twtxt clients for replies and `# prev` archive links
+func TwtHash(url string, created time.Time, text string) string {
+	payload := fmt.Sprintf("%s\n%s\n%s", url, created.Round(time.Second).Format(time.RFC3339), text)
+	sum := blake2b.Sum256([]byte(payload))
+
+	hash := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:]))
+	return hash[len(hash)-twtHashLength:]
+}
+
+// splitFeed splits the contents of a feed file into its comment header and
+// its twt lines
+func splitFeed(data []byte) ([]string, []string) {
+	var header, twts []string
+
+	inHeader := true
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if inHeader && strings.HasPrefix(line, "#") {
+			header = append(header, line)
+			continue
+		}
+		inHeader = false
+
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		twts = append(twts, line)
+	}
+
+	return header, twts
+}
+
+func isPrevComment(line string) bool {
+	parts := strings.SplitN(strings.TrimPrefix(line, "#"), "=", 2)
+	return len(parts) == 2 && strings.TrimSpace(parts[0]) == "prev"
+}
+
+// removePrevLinks removes the `# prev` links from the header of a feed file
+// and reports whether there were any
+func removePrevLinks(data []byte) ([]byte, bool) {
+	header, twts := splitFeed(data)
+
+	var kept []string
+	for _, line := range header {
+		if !isPrevComment(line) {
+			kept = append(kept, line)
+		}
+	}
+
+	if len(kept) == len(header) {
+		return data, false
+	}
+	return append(joinLines(kept), joinLines(twts)...), true
+}
+
+// joinLines joins lines terminating each of them with a newline
+func joinLines(lines []string) []byte {
+	buf := &bytes.Buffer{}
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// ArchiveFile returns the path of the archived segment n of the named feed
+func ArchiveFile(conf *Config, name string, n int64) string {
+	return filepath.Join(conf.Root, fmt.Sprintf("%s.txt.%d", name, n))
+}
+
+// RotateFeed moves all but the most recent KeepTwts twts of the named feed
+// to a new archived segment and links the feed to it with a `# prev` header
+// so clients can follow the history. Older segments stay linked from the
+// header carried over to the new segment.
+func RotateFeed(conf *Config, name string, now time.Time) error {
+	unlock := conf.LockFeed(name)
+	defer unlock()
+
+	defer conf.Index().Refresh(conf, name)
+
+	fn := filepath.Join(conf.Root, fmt.Sprintf("%s.txt", name))
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	header, twts := splitFeed(data)
+	if len(twts) <= conf.KeepTwts {
+		log.Debugf("not rotating %s with only %d twts", name, len(twts))
+		return nil
+	}
+
+	archived := twts[:len(twts)-conf.KeepTwts]
+	kept := twts[len(twts)-conf.KeepTwts:]
+
+	last := strings.SplitN(archived[len(archived)-1], "\t", 2)
+	if len(last) != 2 {
+		return fmt.Errorf("error: invalid twt in %s: %q", fn, archived[len(archived)-1])
+	}
+	created, err := time.Parse(time.RFC3339, last[0])
+	if err != nil {
+		return fmt.Errorf("error parsing twt timestamp in %s: %w", fn, err)
+	}
+	hash := TwtHash(URLForFeed(conf, name), created, last[1])
+
+	n := now.Unix()
+	archiveFile := ArchiveFile(conf, name, n)
+	if Exists(archiveFile) {
+		return fmt.Errorf("error: archive %s already exists", archiveFile)
+	}
+
+	if err := WriteFileAtomic(archiveFile, append(joinLines(header), joinLines(archived)...), 0644); err != nil {
+		return err
+	}
+
+	// The metadata comes first followed by the other comments and the new
+	// `# prev` link, matching the header written by WriteMetadata
+	var meta, extra []string
+	for _, line := range header {
+		switch {
+		case line == "#", isPrevComment(line):
+		case isMetadataComment(line):
+			meta = append(meta, line)
+		default:
+			extra = append(extra, line)
+		}
+	}
+	prev := fmt.Sprintf("# prev = %s twtxt.txt.%d", hash, n)
+	header = append(append(append(meta, extra...), prev), "#")
+
+	return WriteFileAtomic(fn, append(joinLines(header), joinLines(kept)...), 0644)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTwtHash(t *testing.T) {
+	cet := time.FixedZone("CET", 60*60)
+
+	// Expected hashes were computed independently with Python's hashlib
+	// following the twt hash extension: the last 7 characters of the
+	// lowercase unpadded base32 of blake2b-256("url\ncreated\ntext")
+	tests := []struct {
+		url     string
+		created time.Time
+		text    string
+		hash    string
+	}{
+		{
+			"https://example.com/twtxt.txt",
+			time.Date(2020, 12, 25, 16, 55, 57, 0, cet),
+			"Hello World! 😊",
+			"houb6vq",
+		},
+		{
+			// The same instant in UTC is a different twt
+			"https://example.com/twtxt.txt",
+			time.Date(2020, 12, 25, 15, 55, 57, 0, time.UTC),
+			"Hello World! 😊",
+			"rvmrp7q",
+		},
+		{
+			// Sub-second precision is not part of the hash
+			"https://example.com/twtxt.txt",
+			time.Date(2020, 12, 25, 16, 55, 57, 200*int(time.Millisecond), cet),
+			"Hello World! 😊",
+			"houb6vq",
+		},
+		{
+			"https://feeds.twtxt.net/tiktok/twtxt.txt",
+			time.Date(2020, 11, 13, 16, 0, 0, 0, time.UTC),
+			"🕓 The time is now four o'clock in the afternoon 🌅",
+			"jxhelpa",
+		},
+		{
+			"http://127.0.0.1:8001/first/twtxt.txt",
+			time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			"Two ⌘ [更多内容...](http://example.com/2)",
+			"zaydbgq",
+		},
+	}
+
+	for _, test := range tests {
+		if hash := TwtHash(test.url, test.created, test.text); hash != test.hash {
+			t.Errorf("TwtHash(%s, %s, %q) = %s, want %s", test.url, test.created, test.text, hash, test.hash)
+		}
+	}
+}
+
+func TestSplitFeed(t *testing.T) {
+	data := "# nick = test\n# prev = abcdefg twtxt.txt.1\n#\n2020-01-01T00:00:00Z\tone\n\n# comment\n2020-01-02T00:00:00Z\ttwo\r\n"
+
+	header, twts := splitFeed([]byte(data))
+
+	if want := []string{"# nick = test", "# prev = abcdefg twtxt.txt.1", "#"}; strings.Join(header, "|") != strings.Join(want, "|") {
+		t.Errorf("header = %q, want %q", header, want)
+	}
+	if want := []string{"2020-01-01T00:00:00Z\tone", "2020-01-02T00:00:00Z\ttwo"}; strings.Join(twts, "|") != strings.Join(want, "|") {
+		t.Errorf("twts = %q, want %q", twts, want)
+	}
+}
+
+func TestRotateFeed(t *testing.T) {
+	conf := NewConfig()
+	conf.Root = tempDir(t)
+	conf.BaseURL = "http://127.0.0.1:8001"
+	conf.KeepTwts = 2
+
+	fn := filepath.Join(conf.Root, "test.txt")
+	feed := strings.Join([]string{
+		"# nick = test",
+		"# url = http://127.0.0.1:8001/test/twtxt.txt",
+		"# prev = aaaaaaa twtxt.txt.1",
+		"#",
+		"2024-01-01T00:00:00Z\tOne ⌘ [更多内容...](http://example.com/1)",
+		"2024-01-02T00:00:00Z\tTwo ⌘ [更多内容...](http://example.com/2)",
+		"2024-01-03T00:00:00Z\tThree",
+		"2024-01-04T00:00:00Z\tFour",
+	}, "\n") + "\n"
+	if err := ioutil.WriteFile(fn, []byte(feed), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	if err := RotateFeed(conf, "test", now); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	archive, err := ioutil.ReadFile(ArchiveFile(conf, "test", now.Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, twts := splitFeed(archive)
+	if len(header) != 4 || header[2] != "# prev = aaaaaaa twtxt.txt.1" {
+		t.Errorf("archive header = %q, want the original header", header)
+	}
+	if len(twts) != 2 || !strings.Contains(twts[1], "Two") {
+		t.Errorf("archived twts = %q, want the two oldest", twts)
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, twts = splitFeed(data)
+
+	hash := TwtHash(
+		"http://127.0.0.1:8001/test/twtxt.txt",
+		time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		"Two ⌘ [更多内容...](http://example.com/2)",
+	)
+	want := []string{
+		"# nick = test",
+		"# url = http://127.0.0.1:8001/test/twtxt.txt",
+		"# prev = " + hash + " twtxt.txt.1700000000",
+		"#",
+	}
+	if strings.Join(header, "|") != strings.Join(want, "|") {
+		t.Errorf("header = %q, want %q", header, want)
+	}
+	if len(twts) != 2 || !strings.Contains(twts[0], "Three") {
+		t.Errorf("kept twts = %q, want the two newest", twts)
+	}
+
+	// Nothing left to rotate
+	if err := RotateFeed(conf, "test", now.Add(time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if Exists(ArchiveFile(conf, "test", now.Add(time.Hour).Unix())) {
+		t.Error("rotated a feed with only KeepTwts twts")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Role is the role granted to an authenticated token or user
+type Role string
+
+const (
+	// RoleNone is the role of unauthenticated requests
+	RoleNone Role = ""
+
+	// RoleSubmitter may submit new feeds
+	RoleSubmitter Role = "submitter"
+
+	// RoleAdmin may submit, edit and delete feeds
+	RoleAdmin Role = "admin"
+)
+
+type contextKey string
+
+const roleContextKey contextKey = "role"
+
+// Has reports whether the role grants the required role
+func (role Role) Has(required Role) bool {
+	switch required {
+	case RoleNone:
+		return true
+	case RoleSubmitter:
+		return role == RoleSubmitter || role == RoleAdmin
+	case RoleAdmin:
+		return role == RoleAdmin
+	}
+	return false
+}
+
+// Valid reports whether the role is a known role
+func (role Role) Valid() bool {
+	return role == RoleSubmitter || role == RoleAdmin
+}
+
+// TokenConfig is a static API token used as a bearer token
+type TokenConfig struct {
+	Token string
+	Role  Role
+}
+
+// UserConfig is a user authenticated with basic auth
+type UserConfig struct {
+	Password string
+	Role     Role
+}
+
+// AuthConfig configures the optional authentication layer. Authentication
+// is enabled when at least one token or user is configured.
+type AuthConfig struct {
+	Tokens map[string]TokenConfig `yaml:",omitempty"` // name -> token
+	Users  map[string]UserConfig  `yaml:",omitempty"` // username -> user
+}
+
+// Enabled reports whether any tokens or users are configured
+func (auth AuthConfig) Enabled() bool {
+	return len(auth.Tokens) > 0 || len(auth.Users) > 0
+}
+
+// HasAdmin reports whether any token or user has the admin role
+func (auth AuthConfig) HasAdmin() bool {
+	for _, token := range auth.Tokens {
+		if token.Role == RoleAdmin {
+			return true
+		}
+	}
+	for _, user := range auth.Users {
+		if user.Role == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that all tokens and users have a secret and a known role
+func (auth AuthConfig) Validate() error {
+	for name, token := range auth.Tokens {
+		if token.Token == "" {
+			return fmt.Errorf("error: token %s has no token", name)
+		}
+		if !token.Role.Valid() {
+			return fmt.Errorf("error: token %s has invalid role %q", name, token.Role)
+		}
+	}
+
+	for username, user := range auth.Users {
+		if user.Password == "" {
+			return fmt.Errorf("error: user %s has no password", username)
+		}
+		if !user.Role.Valid() {
+			return fmt.Errorf("error: user %s has invalid role %q", username, user.Role)
+		}
+	}
+
+	return nil
+}
+
+// Authenticate returns the role granted by the credentials of the request
+// and whether any credentials that were presented were valid.
+func (auth AuthConfig) Authenticate(r *http.Request) (Role, bool) {
+	if username, password, ok := r.BasicAuth(); ok {
+		user, ok := auth.Users[username]
+		if !ok || !secureCompare(password, user.Password) {
+			return RoleNone, false
+		}
+		return user.Role, true
+	}
+
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return RoleNone, true
+	}
+
+	if !strings.HasPrefix(header, "Bearer ") {
+		return RoleNone, false
+	}
+
+	presented := strings.TrimPrefix(header, "Bearer ")
+	for _, token := range auth.Tokens {
+		if secureCompare(presented, token.Token) {
+			return token.Role, true
+		}
+	}
+
+	return RoleNone, false
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// RoleFromContext returns the role of the authenticated request
+func RoleFromContext(ctx context.Context) Role {
+	if role, ok := ctx.Value(roleContextKey).(Role); ok {
+		return role
+	}
+	return RoleNone
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("WWW-Authenticate", `Basic realm="rss2twt"`)
+	w.Header().Add("WWW-Authenticate", `Bearer realm="rss2twt"`)
+
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		renderJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	http.Error(w, "未授权", http.StatusUnauthorized)
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request, msg string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		renderJSONError(w, http.StatusForbidden, msg)
+		return
+	}
+
+	http.Error(w, "禁止访问", http.StatusForbidden)
+}
+
+// AuthMiddleware authenticates requests that present credentials and stores
+// the granted role in the request context. Requests with invalid credentials
+// are rejected, requests without credentials continue unauthenticated.
+func (app *App) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := app.conf.GetAuth()
+		if !auth.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		role, ok := auth.Authenticate(r)
+		if !ok {
+			log.Warnf("invalid credentials from %s for %s", r.RemoteAddr, r.URL.Path)
+			unauthorized(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), roleContextKey, role)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireRole wraps a handler requiring the authenticated request to have
+// the given role. When authentication is disabled the handler is open to
+// everyone unless an admin role is required or it is part of the API.
+func (app *App) RequireRole(required Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.conf.GetAuth().Enabled() {
+			if required == RoleAdmin || strings.HasPrefix(r.URL.Path, "/api/") {
+				forbidden(w, r, "authentication is not configured")
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		role := RoleFromContext(r.Context())
+		if role == RoleNone {
+			unauthorized(w, r)
+			return
+		}
+
+		if !role.Has(required) {
+			forbidden(w, r, "forbidden")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// RequireSubmitter wraps the public submission form requiring the
+// submitter role, unless submissions are moderated in which case anyone may
+// submit feeds as they are queued for review.
+func (app *App) RequireSubmitter(next http.HandlerFunc) http.HandlerFunc {
+	guarded := app.RequireRole(RoleSubmitter, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.conf.IsModerated() {
+			next(w, r)
+			return
+		}
+		guarded(w, r)
+	}
+}
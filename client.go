@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultMaxFeedSize  = 10 << 20 // 10 MiB
+	defaultMaxImageSize = 5 << 20  // 5 MiB
+)
+
+var (
+	ErrResponseTooLarge = errors.New("error: response too large")
+)
+
+// HTTPConfig configures the client used for all outgoing requests
+type HTTPConfig struct {
+	Proxy        string `yaml:",omitempty"` // proxy url, defaults to HTTP(S)_PROXY from the environment
+	MaxFeedSize  int64  // maximum size of feeds and web pages in bytes (unlimited if zero)
+	MaxImageSize int64  // maximum size of avatar images in bytes (unlimited if zero)
+
+	Deny  []string `yaml:",omitempty"` // addresses or cidrs never fetched in addition to reserved ranges
+	Allow []string `yaml:",omitempty"` // hosts, addresses or cidrs of trusted internal feeds
+}
+
+// Validate checks that the proxy url (if any) and guard lists are valid
+func (conf HTTPConfig) Validate() error {
+	if _, err := NewGuard(conf.Deny, conf.Allow); err != nil {
+		return err
+	}
+
+	if conf.Proxy == "" {
+		return nil
+	}
+
+	u, err := url.Parse(conf.Proxy)
+	if err != nil {
+		return fmt.Errorf("error parsing proxy url: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("error: invalid proxy url %s", conf.Proxy)
+	}
+
+	return nil
+}
+
+// UserAgent returns the User-Agent sent with all outgoing requests
+func UserAgent(conf *Config) string {
+	if conf.BaseURL == "" {
+		return fmt.Sprintf("rss2twt/%s", FullVersion())
+	}
+	return fmt.Sprintf("rss2twt/%s (+%s)", FullVersion(), conf.BaseURL)
+}
+
+// userAgentTransport sets the User-Agent on requests that don't have one
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// NewHTTPClient returns a client configured with the timeouts, User-Agent,
+// proxy and destination guard from conf
+func NewHTTPClient(conf *Config) *http.Client {
+	// Validated in LoadConfig()
+	guard, err := NewGuard(conf.HTTP.Deny, conf.HTTP.Allow)
+	if err != nil {
+		guard, _ = NewGuard(nil, nil)
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if conf.HTTP.Proxy != "" {
+		if u, err := url.Parse(conf.HTTP.Proxy); err == nil {
+			proxy = http.ProxyURL(u)
+		}
+	}
+
+	return newHTTPClient(conf, guard, proxy)
+}
+
+func newHTTPClient(conf *Config, guard *Guard, proxy func(*http.Request) (*url.URL, error)) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   conf.Timeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           guard.DialContext(dialer),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: conf.Timeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout: conf.Timeout,
+		Transport: &userAgentTransport{
+			userAgent: UserAgent(conf),
+			next: &guardTransport{
+				guard: guard,
+				proxy: proxy,
+				next:  transport,
+			},
+		},
+	}
+}
+
+// Client returns the shared client used for all outgoing requests
+func (conf *Config) Client() *http.Client {
+	conf.clientOnce.Do(func() {
+		conf.client = NewHTTPClient(conf)
+	})
+	return conf.client
+}
+
+// Get fetches url with the shared client failing on non-2xx responses
+func Get(conf *Config, url string) (*http.Response, error) {
+	return GetContext(context.Background(), conf, url)
+}
+
+// GetContext is like Get but gives up once ctx is done
+func GetContext(ctx context.Context, conf *Config, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := conf.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, fmt.Errorf("error: unexpected response %s from %s", res.Status, url)
+	}
+
+	return res, nil
+}
+
+// limitedReader reads at most n bytes failing with ErrResponseTooLarge if
+// the underlying reader has more
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+// LimitReader returns a reader that reads at most n bytes from r and fails
+// with ErrResponseTooLarge if r has more. If n is zero r is returned as is.
+func LimitReader(r io.Reader, n int64) io.Reader {
+	if n <= 0 {
+		return r
+	}
+	return &limitedReader{r, n}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, ErrResponseTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
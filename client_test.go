@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitReader(t *testing.T) {
+	tests := []struct {
+		data  string
+		limit int64
+		err   error
+	}{
+		{"12345", 5, nil},
+		{"12345", 10, nil},
+		{"123456", 5, ErrResponseTooLarge},
+		{"123456", 0, nil},
+	}
+
+	for _, test := range tests {
+		data, err := ioutil.ReadAll(LimitReader(strings.NewReader(test.data), test.limit))
+		if err != test.err {
+			t.Errorf("%q limited to %d: error = %v, want %v", test.data, test.limit, err, test.err)
+		}
+		if err == nil && string(data) != test.data {
+			t.Errorf("%q limited to %d: read %q", test.data, test.limit, data)
+		}
+	}
+}
+
+func TestClientUserAgent(t *testing.T) {
+	agents := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+
+	conf := newLocalConfig()
+	conf.BaseURL = "https://feeds.example.com"
+
+	res, err := Get(conf, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if agent, want := <-agents, UserAgent(conf); agent != want {
+		t.Errorf("User-Agent = %q, want %q", agent, want)
+	}
+	if !strings.Contains(UserAgent(conf), "+https://feeds.example.com") {
+		t.Errorf("User-Agent %q does not link to the instance", UserAgent(conf))
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+)
+
+// Command is a subcommand of the cli
+type Command struct {
+	Name  string
+	Args  string // usage of the positional arguments
+	Short string // one line description shown in the usage
+
+	// Flags adds the command's flags to fs and returns the function that
+	// runs the command with the remaining arguments
+	Flags func(fs *flag.FlagSet) func(args []string) error
+}
+
+var (
+	ErrUsage = errors.New("error: invalid arguments")
+
+	// Commands are the subcommands of the cli, all of which operate on
+	// the feeds of the config file given by --config
+	Commands []Command
+)
+
+func init() {
+	Commands = []Command{
+		{"serve", "", "运行 Web 服务", serveCommand},
+		{"add", "<url> [name]", "添加 Feed 源", addCommand},
+		{"remove", "<name>", "删除 Feed 源及其文件", removeCommand},
+		{"list", "", "列出所有 Feed 源", listCommand},
+		{"update", "[name...]", "立即更新指定的（默认所有启用的）Feed 源", updateCommand},
+		{"validate", "<url>", "检查 URL 是否为有效的 RSS/Atom/JSON Feed", validateCommand},
+		{"discover", "<site>", "查找网站提供的 Feed", discoverCommand},
+		{"rotate", "[name...]", "归档超过大小上限的（或指定的）Feed 源", rotateCommand},
+		{"config", "check", "检查配置文件", configCommand},
+	}
+}
+
+// FindCommand returns the named command
+func FindCommand(name string) (Command, bool) {
+	for _, cmd := range Commands {
+		if cmd.Name == name {
+			return cmd, true
+		}
+	}
+	return Command{}, false
+}
+
+// Run parses the command's flags from args and runs it
+func (cmd Command) Run(args []string) error {
+	fs := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "用法: %s [配置项] %s [命令配置项] %s\n", os.Args[0], cmd.Name, cmd.Args)
+		fs.PrintDefaults()
+	}
+
+	run := cmd.Flags(fs)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		return ErrUsage
+	}
+
+	err := run(fs.Args())
+	if err == ErrUsage {
+		fs.Usage()
+	}
+	return err
+}
+
+// loadConfig loads the config file used by all commands and indexes the
+// generated feeds
+func loadConfig() (*Config, error) {
+	conf, err := LoadConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	conf.Index().Build(conf)
+	return conf, nil
+}
+
+// saved saves the config and tells a server running with it to reload it
+func saved(conf *Config) error {
+	if err := conf.Save(); err != nil {
+		return err
+	}
+	notifyServer(conf)
+	return nil
+}
+
+// notifyServer sends SIGHUP to the server running with the config, if any,
+// so that it applies the feeds added or removed by the cli
+func notifyServer(conf *Config) {
+	pid, ok := serverPID(conf.PIDFile())
+	if !ok {
+		return
+	}
+
+	p, err := os.FindProcess(pid)
+	if err == nil {
+		err = p.Signal(syscall.SIGHUP)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "通知运行中的服务（pid %d）失败: %s，需发送 SIGHUP 后生效\n", pid, err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "已通知运行中的服务（pid %d）重新加载配置\n", pid)
+}
+
+func serveCommand(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) > 0 {
+			return ErrUsage
+		}
+
+		app, err := NewApp(bind, config)
+		if err != nil {
+			return fmt.Errorf("error creating app for server mode: %w", err)
+		}
+		return app.Run()
+	}
+}
+
+func addCommand(fs *flag.FlagSet) func(args []string) error {
+	var feed FeedConfig
+	fs.DurationVar(&feed.Interval, "interval", 0, "抓取间隔（默认使用全局设置）")
+	fs.StringVar(&feed.Template, "template", "", "Twt 模板（默认使用全局设置）")
+	fs.StringVar(&feed.Avatar, "avatar", "", "头像图片 URL（默认使用 Feed 的图片）")
+
+	return func(args []string) error {
+		if len(args) < 1 || len(args) > 2 {
+			return ErrUsage
+		}
+
+		conf, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		if _, err := ParseTwtTemplate("feed", feed.Template); err != nil {
+			return fmt.Errorf("error parsing template: %w", err)
+		}
+
+		found, err := ValidateFeed(conf, args[0])
+		if multiple, ok := err.(*MultipleFeedsError); ok {
+			printCandidates(multiple.Candidates)
+			return errors.New("error: multiple feeds found, add one of the candidates")
+		}
+		if err != nil {
+			return err
+		}
+
+		name := found.Name
+		if len(args) == 2 {
+			name = args[1]
+		}
+		if !validName.MatchString(name) {
+			return ErrInvalidName
+		}
+
+		feed.URL = found.URL
+		if err := conf.AddFeed(name, feed); err != nil {
+			return err
+		}
+		if err := saved(conf); err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\t%s\n", name, feed.URL)
+		return nil
+	}
+}
+
+func removeCommand(fs *flag.FlagSet) func(args []string) error {
+	var opts DeleteOptions
+	fs.BoolVar(&opts.KeepArchives, "keep-archives", false, "保留归档文件（需同时使用 --tombstone）")
+	fs.BoolVar(&opts.Tombstone, "tombstone", false, "保留 Feed 文件并追加停止更新的 Twt")
+
+	return func(args []string) error {
+		if len(args) != 1 {
+			return ErrUsage
+		}
+
+		conf, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		if _, err := DeleteFeed(conf, args[0], opts, time.Now()); err != nil {
+			return err
+		}
+		notifyServer(conf)
+		return nil
+	}
+}
+
+func listCommand(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) > 0 {
+			return ErrUsage
+		}
+
+		conf, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		feeds := conf.AllFeeds()
+		names := make([]string, 0, len(feeds))
+		for name := range feeds {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tURL\tSTATUS\tTWTS\tUPDATED")
+		for _, name := range names {
+			feed := feeds[name]
+
+			status := "active"
+			if feed.Disabled {
+				status = "disabled"
+			}
+
+			twts, updated := "-", "never"
+			if stats, ok := conf.Index().Get(name); ok {
+				twts = fmt.Sprintf("%d", stats.Twts)
+				updated = humanize.Time(stats.ModTime)
+				if stats.Failures > 0 {
+					status = fmt.Sprintf("%s (%d failures)", status, stats.Failures)
+				}
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, feed.URL, status, twts, updated)
+		}
+		return w.Flush()
+	}
+}
+
+func updateCommand(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		conf, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		feeds := conf.AllFeeds()
+		if len(args) == 0 {
+			for name, feed := range feeds {
+				if !feed.Disabled {
+					args = append(args, name)
+				}
+			}
+			sort.Strings(args)
+		}
+
+		// Disables feeds that are gone or failing for too long and moves
+		// permanently redirected feeds like the server does
+		job := NewUpdateFeedsJob(conf).(*UpdateFeedsJob)
+
+		var (
+			failed  []string
+			changed bool
+		)
+		for _, name := range args {
+			feed, ok := feeds[name]
+			if !ok {
+				log.Errorf("feed %s not found", name)
+				failed = append(failed, name)
+				continue
+			}
+
+			if err := UpdateFeed(conf, name, feed); err != nil {
+				log.WithError(err).Errorf("error updating feed %s: %s", name, feed.URL)
+				failed = append(failed, name)
+			} else {
+				log.Infof("updated feed %s", name)
+			}
+
+			job.afterPoll(name, feed)
+			if updated, ok := conf.GetFeed(name); ok && updated != feed {
+				changed = true
+			}
+		}
+
+		if changed {
+			notifyServer(conf)
+		}
+
+		if len(failed) > 0 {
+			return fmt.Errorf("error: failed to update %s", strings.Join(failed, ", "))
+		}
+		return nil
+	}
+}
+
+// oneShot adds the feed at url as name, unless a feed with that name was
+// added before, and updates it. It keeps the `rss2twt <url> <name>` form of
+// earlier versions working.
+func oneShot(url, name string) error {
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := conf.GetFeed(name); !ok {
+		add, _ := FindCommand("add")
+		if err := add.Run([]string{url, name}); err != nil {
+			return err
+		}
+	}
+
+	update, _ := FindCommand("update")
+	return update.Run([]string{name})
+}
+
+func validateCommand(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return ErrUsage
+		}
+
+		conf, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		feed, err := TestFeed(conf, args[0])
+		if err != nil {
+			return fmt.Errorf("error: %s is not a valid feed: %w", args[0], err)
+		}
+
+		fmt.Printf("%s\t%s\t%d items\n", feed.FeedType, feed.Title, len(feed.Items))
+		return nil
+	}
+}
+
+func discoverCommand(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return ErrUsage
+		}
+
+		conf, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		candidates, err := FindFeeds(conf, args[0])
+		if err != nil {
+			return err
+		}
+
+		printCandidates(candidates)
+		return nil
+	}
+}
+
+func printCandidates(candidates []FeedCandidate) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, candidate := range candidates {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", candidate.URL, candidate.Type, candidate.Title)
+	}
+	w.Flush()
+}
+
+func rotateCommand(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		conf, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		if len(args) == 0 {
+			NewRotateFeedsJob(conf).Run()
+			return nil
+		}
+
+		for _, name := range args {
+			if err := RotateFeed(conf, name, time.Now()); err != nil {
+				return fmt.Errorf("error rotating feed %s: %w", name, err)
+			}
+		}
+		return nil
+	}
+}
+
+func configCommand(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 1 || args[0] != "check" {
+			return ErrUsage
+		}
+
+		conf, err := LoadConfig(config)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf(
+			"%s: ok (%d feeds, %d pending)\n",
+			config, len(conf.AllFeeds()), len(conf.AllPending()),
+		)
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// useConfig makes the commands use the config file fn
+func useConfig(t *testing.T, fn string) {
+	old := config
+	config = fn
+	t.Cleanup(func() { config = old })
+}
+
+func TestUpdateCommand(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/moved.xml", http.RedirectHandler("/feed.xml", http.StatusMovedPermanently))
+	mux.HandleFunc("/gone.xml", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	})
+	mux.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprintf(w, testRSS, "updated")
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fn := writeConfig(t, fmt.Sprintf(`
+root: %s
+redirectthreshold: 1
+http:
+  allow: ["127.0.0.1"]
+feeds:
+  gone: %s/gone.xml
+  moved: %s/moved.xml
+`, tempDir(t), server.URL, server.URL))
+	useConfig(t, fn)
+
+	update, _ := FindCommand("update")
+	if err := update.Run(nil); err == nil {
+		t.Error("expected an error updating a feed that is gone")
+	}
+
+	conf := mustLoadConfig(t, fn)
+	if gone, _ := conf.GetFeed("gone"); !gone.Disabled {
+		t.Error("feed that is gone not disabled")
+	}
+	if moved, _ := conf.GetFeed("moved"); moved.URL != server.URL+"/feed.xml" {
+		t.Errorf("url of moved feed = %s, want %s", moved.URL, server.URL+"/feed.xml")
+	}
+}
+
+func TestOneShot(t *testing.T) {
+	server := newFeedServer(t, fmt.Sprintf(testRSS, "one shot"))
+
+	root := tempDir(t)
+	fn := writeConfig(t, fmt.Sprintf("root: %s\nhttp:\n  allow: [\"127.0.0.1\"]\n", root))
+	useConfig(t, fn)
+
+	// Running it again updates the feed added the first time
+	for i := 0; i < 2; i++ {
+		if err := oneShot(server.URL+"/feed.xml", "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := mustLoadConfig(t, fn)
+	if feed, ok := conf.GetFeed("test"); !ok || feed.URL != server.URL+"/feed.xml" {
+		t.Errorf("got feed %v, want %s", feed, server.URL+"/feed.xml")
+	}
+	if !Exists(filepath.Join(root, "test.txt")) {
+		t.Error("feed not updated")
+	}
+}
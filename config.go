@@ -1,30 +1,613 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-yaml/yaml"
+	log "github.com/sirupsen/logrus"
+)
+
+// FeedConfig holds the configuration of a single feed
+type FeedConfig struct {
+	URL      string
+	Nick     string        `yaml:",omitempty"` // display nick overriding the feed's name
+	Interval time.Duration `yaml:",omitempty"` // poll interval overriding the default
+	Template string        `yaml:",omitempty"` // template overriding the default
+	Avatar   string        `yaml:",omitempty"` // avatar image url overriding the feed's image
+	Disabled bool          `yaml:",omitempty"` // disabled feeds are not polled
+}
+
+// DisplayNick returns the nick of the named feed written to its metadata
+func (feed FeedConfig) DisplayNick(name string) string {
+	if feed.Nick != "" {
+		return feed.Nick
+	}
+	return name
+}
+
+// UnmarshalYAML supports both the short `name: url` form and the full form
+func (feed *FeedConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url string
+	if err := unmarshal(&url); err == nil {
+		*feed = FeedConfig{URL: url}
+		return nil
+	}
+
+	type plain FeedConfig
+	return unmarshal((*plain)(feed))
+}
+
+// MarshalYAML uses the short `name: url` form when only the url is set
+func (feed FeedConfig) MarshalYAML() (interface{}, error) {
+	if feed == (FeedConfig{URL: feed.URL}) {
+		return feed.URL, nil
+	}
+
+	type plain FeedConfig
+	return plain(feed), nil
+}
+
+// PollConfig controls when feeds are polled and when failing or redirected
+// feeds are disabled or moved. It is applied when the config is reloaded.
+type PollConfig struct {
+	Interval          time.Duration // default interval between polls of a feed
+	HonorTTL          bool          `yaml:",omitempty"` // poll no more often than feeds advertise
+	MaxBackoff        time.Duration // maximum interval between polls of a failing feed
+	DisableAfter      time.Duration `yaml:",omitempty"` // disable feeds failing for this long (never if zero)
+	RedirectThreshold int           // permanent redirects before updating a feed's url (never if zero)
+}
+
+// PollInterval returns the interval between polls of the given feed. Unless
+// the feed overrides it, the default interval is used, lengthened to the
+// update interval advertised by the feed (up to MaxBackoff) if HonorTTL is
+// enabled.
+func (poll PollConfig) PollInterval(feed FeedConfig, ttl time.Duration) time.Duration {
+	if feed.Interval > 0 {
+		return feed.Interval
+	}
+
+	if poll.HonorTTL && ttl > poll.Interval {
+		if ttl > poll.MaxBackoff {
+			return poll.MaxBackoff
+		}
+		return ttl
+	}
+
+	return poll.Interval
+}
+
+const (
+	defaultWorkers = 4
+	defaultTimeout = time.Second * 30
+
+	defaultInterval   = time.Minute * 5
+	defaultMaxBackoff = time.Hour * 24
+
+	defaultRedirectThreshold = 3
+
+	defaultKeepTwts = 20
+)
+
+var (
+	ErrFeedExists   = errors.New("error: feed already exists")
+	ErrFeedNotFound = errors.New("error: feed not found")
+
+	// ErrServerRunning is returned when starting a server with a config
+	// file already used by a running server
+	ErrServerRunning = errors.New("error: a server is already running with this config")
 )
 
 type Config struct {
-	Root    string
-	BaseURL string
-	MaxSize int64             // maximum feed size before rotating
-	Feeds   map[string]string // name -> url
+	Root       string
+	BaseURL    string
+	MaxSize    int64                 // maximum feed size before rotating
+	KeepTwts   int                   // most recent twts kept in a feed when rotating it
+	Retention  RetentionConfig       `yaml:",omitempty"` // limits on archived segments
+	Workers    int                   // number of feeds polled concurrently
+	Timeout    time.Duration         // timeout for requests to upstream feeds
+	PollConfig `yaml:",inline"`      // when feeds are polled
+	Template   string                `yaml:",omitempty"` // default template used to render twts
+	Feeds      map[string]FeedConfig // name -> feed
+	Pending    map[string]FeedConfig `yaml:",omitempty"` // name -> feed awaiting moderation
+	Redirects  map[string]string     `yaml:",omitempty"` // old name -> new name of renamed feeds
+	Tombstones map[string]time.Time  `yaml:",omitempty"` // name -> when a deleted feed was ended
+	Moderate   bool                  `yaml:",omitempty"` // queue feeds submitted by non-admins for review
+	Auth       AuthConfig            `yaml:",omitempty"` // optional authentication
+	HTTP       HTTPConfig            // outgoing http client
+	Watch      bool                  `yaml:",omitempty"` // reload the config file when it changes
 
 	path string // path to config file that was loaded used by .Save()
+
+	// mu guards Feeds, Pending, Redirects and Tombstones and the settings
+	// applied on reload: Template, PollConfig, Moderate and Auth
+	mu      *sync.RWMutex
+	reloads int // number of reloads that rescheduled feeds, see .Reloads()
+
+	saveMu *sync.Mutex // serializes .Save() so the latest snapshot wins
+	saved  []byte      // contents of the config file last loaded or saved
+
+	client     *http.Client // shared client used by .Client()
+	clientOnce *sync.Once
+
+	feedLocks   map[string]*sync.Mutex // name -> lock used by .LockFeed()
+	feedLocksMu *sync.Mutex
+
+	index *FeedIndex // generated feeds returned by .Index()
+
+	done     chan struct{} // closed by .Shutdown()
+	doneOnce *sync.Once
+}
+
+// NewConfig returns an empty configuration
+func NewConfig() *Config {
+	return &Config{
+		KeepTwts: defaultKeepTwts,
+		Workers:  defaultWorkers,
+		Timeout:  defaultTimeout,
+
+		PollConfig: PollConfig{
+			Interval:          defaultInterval,
+			MaxBackoff:        defaultMaxBackoff,
+			RedirectThreshold: defaultRedirectThreshold,
+		},
+
+		HTTP: HTTPConfig{
+			MaxFeedSize:  defaultMaxFeedSize,
+			MaxImageSize: defaultMaxImageSize,
+		},
+
+		Feeds:      make(map[string]FeedConfig),
+		Pending:    make(map[string]FeedConfig),
+		Redirects:  make(map[string]string),
+		Tombstones: make(map[string]time.Time),
+
+		mu:     &sync.RWMutex{},
+		saveMu: &sync.Mutex{},
+
+		clientOnce: &sync.Once{},
+
+		feedLocks:   make(map[string]*sync.Mutex),
+		feedLocksMu: &sync.Mutex{},
+
+		index: NewFeedIndex(),
+
+		done:     make(chan struct{}),
+		doneOnce: &sync.Once{},
+	}
 }
 
 func (conf *Config) Parse(data []byte) error {
 	return yaml.Unmarshal(data, conf)
 }
 
+// LockFeed locks the files of the given feed so that updates and rotation
+// don't interleave and returns the function that unlocks it. Feeds of a
+// config loaded from a file are also locked across processes, so that the
+// cli and a running server don't interleave either.
+func (conf *Config) LockFeed(name string) func() {
+	conf.feedLocksMu.Lock()
+	lock, ok := conf.feedLocks[name]
+	if !ok {
+		lock = &sync.Mutex{}
+		conf.feedLocks[name] = lock
+	}
+	conf.feedLocksMu.Unlock()
+
+	lock.Lock()
+	if conf.path == "" {
+		return lock.Unlock
+	}
+
+	unlockFile, err := lockFile(feedFile(conf, name, "lock"))
+	if err != nil {
+		log.WithError(err).Warnf("error locking feed %s, only locking it within this process", name)
+		return lock.Unlock
+	}
+	return func() {
+		unlockFile()
+		lock.Unlock()
+	}
+}
+
+// configLock returns the path of the file locked while the config file is
+// read and written
+func (conf *Config) configLock() string {
+	return conf.path + ".lock"
+}
+
+// PIDFile returns the path of the file holding the pid of the server
+// running with the config file
+func (conf *Config) PIDFile() string {
+	return conf.path + ".pid"
+}
+
+// Shutdown tells background jobs to stop once they are done with the feed
+// they are working on
+func (conf *Config) Shutdown() {
+	conf.doneOnce.Do(func() { close(conf.done) })
+}
+
+// ShuttingDown reports whether .Shutdown() was called
+func (conf *Config) ShuttingDown() bool {
+	select {
+	case <-conf.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// TwtTemplate returns the template used to render twts for the given feed
+func (conf *Config) TwtTemplate(feed FeedConfig) string {
+	if feed.Template != "" {
+		return feed.Template
+	}
+
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+	return conf.Template
+}
+
+// Polling returns the current polling settings
+func (conf *Config) Polling() PollConfig {
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+	return conf.PollConfig
+}
+
+// PollInterval returns the interval between polls of the given feed with the
+// current polling settings
+func (conf *Config) PollInterval(feed FeedConfig, ttl time.Duration) time.Duration {
+	return conf.Polling().PollInterval(feed, ttl)
+}
+
+// Reloads returns a counter that changes whenever a reload rescheduled
+// feeds, so that cached schedules can be discarded
+func (conf *Config) Reloads() int {
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+	return conf.reloads
+}
+
+// GetAuth returns the current authentication settings
+func (conf *Config) GetAuth() AuthConfig {
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+	return conf.Auth
+}
+
+// IsModerated reports whether feeds submitted by non-admins are queued for
+// review
+func (conf *Config) IsModerated() bool {
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+	return conf.Moderate
+}
+
+// HasFeed reports whether a feed with the given name exists or is pending,
+// or the name is still in use by a renamed or ended feed
+func (conf *Config) HasFeed(name string) bool {
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+
+	return conf.hasFeed(name)
+}
+
+func (conf *Config) hasFeed(name string) bool {
+	if _, ok := conf.Feeds[name]; ok {
+		return true
+	}
+	if _, ok := conf.Pending[name]; ok {
+		return true
+	}
+	if _, ok := conf.Redirects[name]; ok {
+		return true
+	}
+	_, ok := conf.Tombstones[name]
+	return ok
+}
+
+// GetFeed returns the named feed
+func (conf *Config) GetFeed(name string) (FeedConfig, bool) {
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+
+	feed, ok := conf.Feeds[name]
+	return feed, ok
+}
+
+// AllFeeds returns a snapshot of all feeds
+func (conf *Config) AllFeeds() map[string]FeedConfig {
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+
+	return copyFeeds(conf.Feeds)
+}
+
+// AllPending returns a snapshot of all feeds awaiting moderation
+func (conf *Config) AllPending() map[string]FeedConfig {
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+
+	return copyFeeds(conf.Pending)
+}
+
+// AddFeed adds a new feed failing if one with the same name already exists
+func (conf *Config) AddFeed(name string, feed FeedConfig) error {
+	conf.mu.Lock()
+	defer conf.mu.Unlock()
+
+	if conf.hasFeed(name) {
+		return ErrFeedExists
+	}
+	conf.Feeds[name] = feed
+	return nil
+}
+
+// AddPending queues a new feed for moderation failing if one with the same
+// name already exists
+func (conf *Config) AddPending(name string, feed FeedConfig) error {
+	conf.mu.Lock()
+	defer conf.mu.Unlock()
+
+	if conf.hasFeed(name) {
+		return ErrFeedExists
+	}
+	conf.Pending[name] = feed
+	return nil
+}
+
+// ModifyFeed atomically applies fn to the named feed and returns the result.
+// The feed is left unchanged if fn returns an error.
+func (conf *Config) ModifyFeed(name string, fn func(feed *FeedConfig) error) (FeedConfig, error) {
+	conf.mu.Lock()
+	defer conf.mu.Unlock()
+
+	feed, ok := conf.Feeds[name]
+	if !ok {
+		return FeedConfig{}, ErrFeedNotFound
+	}
+
+	if err := fn(&feed); err != nil {
+		return FeedConfig{}, err
+	}
+
+	conf.Feeds[name] = feed
+	return feed, nil
+}
+
+// RemoveFeed removes the named feed
+func (conf *Config) RemoveFeed(name string) (FeedConfig, error) {
+	conf.mu.Lock()
+	defer conf.mu.Unlock()
+
+	feed, ok := conf.Feeds[name]
+	if !ok {
+		return FeedConfig{}, ErrFeedNotFound
+	}
+	delete(conf.Feeds, name)
+	return feed, nil
+}
+
+// EndFeed removes the named feed keeping its name reserved by a tombstone
+func (conf *Config) EndFeed(name string, now time.Time) (FeedConfig, error) {
+	conf.mu.Lock()
+	defer conf.mu.Unlock()
+
+	feed, ok := conf.Feeds[name]
+	if !ok {
+		return FeedConfig{}, ErrFeedNotFound
+	}
+	delete(conf.Feeds, name)
+	conf.Tombstones[name] = now
+	return feed, nil
+}
+
+// IsEnded reports whether the named feed was deleted with a tombstone
+func (conf *Config) IsEnded(name string) bool {
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+
+	_, ok := conf.Tombstones[name]
+	return ok
+}
+
+// RenameFeed renames a feed recording a redirect from the old name
+func (conf *Config) RenameFeed(from, to string) (FeedConfig, error) {
+	conf.mu.Lock()
+	defer conf.mu.Unlock()
+
+	feed, ok := conf.Feeds[from]
+	if !ok {
+		return FeedConfig{}, ErrFeedNotFound
+	}
+
+	// Renaming a feed back to a previous name replaces the redirect
+	if conf.Redirects[to] == from {
+		delete(conf.Redirects, to)
+	}
+	if conf.hasFeed(to) {
+		return FeedConfig{}, ErrFeedExists
+	}
+
+	delete(conf.Feeds, from)
+	conf.Feeds[to] = feed
+
+	for name, target := range conf.Redirects {
+		if target == from {
+			conf.Redirects[name] = to
+		}
+	}
+	conf.Redirects[from] = to
+
+	return feed, nil
+}
+
+// Redirect returns the new name of a renamed feed
+func (conf *Config) Redirect(name string) (string, bool) {
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+
+	to, ok := conf.Redirects[name]
+	return to, ok
+}
+
+// ApprovePending moves the named feed from the moderation queue to the feeds
+func (conf *Config) ApprovePending(name string) (FeedConfig, error) {
+	conf.mu.Lock()
+	defer conf.mu.Unlock()
+
+	feed, ok := conf.Pending[name]
+	if !ok {
+		return FeedConfig{}, ErrFeedNotFound
+	}
+	if _, ok := conf.Feeds[name]; ok {
+		return FeedConfig{}, ErrFeedExists
+	}
+
+	delete(conf.Pending, name)
+	conf.Feeds[name] = feed
+	return feed, nil
+}
+
+// RejectPending removes the named feed from the moderation queue
+func (conf *Config) RejectPending(name string) (FeedConfig, error) {
+	conf.mu.Lock()
+	defer conf.mu.Unlock()
+
+	feed, ok := conf.Pending[name]
+	if !ok {
+		return FeedConfig{}, ErrFeedNotFound
+	}
+	delete(conf.Pending, name)
+	return feed, nil
+}
+
+func copyFeeds(feeds map[string]FeedConfig) map[string]FeedConfig {
+	copy := make(map[string]FeedConfig, len(feeds))
+	for name, feed := range feeds {
+		copy[name] = feed
+	}
+	return copy
+}
+
+// Validate checks that the configuration is usable
+func (conf *Config) Validate() error {
+	if conf.Workers < 1 {
+		return fmt.Errorf("error: workers must be at least 1")
+	}
+
+	if conf.Timeout <= 0 {
+		return fmt.Errorf("error: timeout must be positive")
+	}
+
+	if conf.Interval < time.Minute {
+		return fmt.Errorf("error: interval must be at least 1m")
+	}
+
+	if conf.MaxBackoff < conf.Interval {
+		return fmt.Errorf("error: maxbackoff must be at least the interval")
+	}
+
+	if conf.RedirectThreshold < 0 {
+		return fmt.Errorf("error: redirectthreshold must not be negative")
+	}
+
+	if conf.KeepTwts < 0 {
+		return fmt.Errorf("error: keeptwts must not be negative")
+	}
+
+	if err := conf.Retention.Validate(); err != nil {
+		return err
+	}
+
+	if err := conf.HTTP.Validate(); err != nil {
+		return err
+	}
+
+	if err := conf.Auth.Validate(); err != nil {
+		return err
+	}
+
+	// Pending feeds can only be approved by an admin
+	if conf.Moderate && !conf.Auth.HasAdmin() {
+		return fmt.Errorf("error: moderate requires an admin user or token in auth")
+	}
+
+	if _, err := ParseTwtTemplate("default", conf.Template); err != nil {
+		return fmt.Errorf("error parsing template: %w", err)
+	}
+
+	for name, feed := range conf.Feeds {
+		if feed.URL == "" {
+			return fmt.Errorf("error: feed %s has no url", name)
+		}
+		if err := ValidateNick(feed.Nick); err != nil {
+			return fmt.Errorf("error: invalid nick for %s: %w", name, err)
+		}
+		if _, err := ParseTwtTemplate(name, feed.Template); err != nil {
+			return fmt.Errorf("error parsing template for %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Save writes the feeds and the settings applied on reload to the config
+// file. Changes made to the file by other processes since it was last read
+// or written, such as feeds added or removed with the cli while a server is
+// running, are merged first so they aren't overwritten, and settings that
+// are only applied on restart are kept as they are in the file. Nothing is
+// written if the file can't be parsed.
 func (conf *Config) Save() error {
-	data, err := yaml.Marshal(conf)
+	conf.saveMu.Lock()
+	defer conf.saveMu.Unlock()
+
+	unlock, err := lockFile(conf.configLock())
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(conf.path, data, 0644)
+	defer unlock()
+
+	latest, diff, err := conf.mergeFile()
+	if err != nil {
+		return err
+	}
+
+	conf.mu.RLock()
+	doc := conf
+	if latest != nil {
+		doc = latest
+		doc.setReloadable(conf)
+	}
+	data, err := yaml.Marshal(doc)
+	conf.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := WriteFileAtomic(conf.path, data, 0644); err != nil {
+		return err
+	}
+	conf.saved = data
+
+	conf.updateIndex(diff)
+
+	return nil
+}
+
+// ValidateNick checks that a display nick can be written to a feed's header
+func ValidateNick(nick string) error {
+	if strings.ContainsAny(nick, " \t\r\n") {
+		return errors.New("nick must not contain whitespace")
+	}
+	return nil
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -32,14 +615,36 @@ func LoadConfig(filename string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	conf := &Config{}
+	return parseConfig(data, filename)
+}
+
+// parseConfig parses and validates the contents of the config file filename
+func parseConfig(data []byte, filename string) (*Config, error) {
+	conf := NewConfig()
 	if err := conf.Parse(data); err != nil {
 		return nil, err
 	}
 	conf.path = filename
+	conf.saved = data
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
 
 	if conf.Feeds == nil {
-		conf.Feeds = make(map[string]string)
+		conf.Feeds = make(map[string]FeedConfig)
+	}
+
+	if conf.Pending == nil {
+		conf.Pending = make(map[string]FeedConfig)
+	}
+
+	if conf.Redirects == nil {
+		conf.Redirects = make(map[string]string)
+	}
+
+	if conf.Tombstones == nil {
+		conf.Tombstones = make(map[string]time.Time)
 	}
 
 	return conf, nil
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-yaml/yaml"
+)
+
+// tempDir creates a temporary directory removed when the test ends
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rss2twt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// writeConfig writes a config file to a temporary directory and returns
+// its path
+func writeConfig(t *testing.T, data string) string {
+	fn := filepath.Join(tempDir(t), "config.yaml")
+	if err := ioutil.WriteFile(fn, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestLoadConfigLegacy(t *testing.T) {
+	fn := writeConfig(t, `
+root: ./feeds
+baseurl: http://127.0.0.1:8000
+interval: 10m
+maxbackoff: 24h
+feeds:
+  hn: https://news.ycombinator.com/rss
+  xkcd: https://xkcd.com/rss.xml
+`)
+
+	conf, err := LoadConfig(fn)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := map[string]FeedConfig{
+		"hn":   {URL: "https://news.ycombinator.com/rss"},
+		"xkcd": {URL: "https://xkcd.com/rss.xml"},
+	}
+	if !reflect.DeepEqual(conf.Feeds, want) {
+		t.Errorf("feeds = %+v, want %+v", conf.Feeds, want)
+	}
+	if conf.Interval != 10*time.Minute {
+		t.Errorf("interval = %s, want 10m", conf.Interval)
+	}
+	if conf.Workers != defaultWorkers || conf.KeepTwts != defaultKeepTwts {
+		t.Error("defaults were not kept for unset settings")
+	}
+	if conf.Pending == nil || conf.Redirects == nil || conf.Tombstones == nil {
+		t.Error("maps were not initialized")
+	}
+}
+
+func TestLoadConfigStructured(t *testing.T) {
+	fn := writeConfig(t, `
+root: ./feeds
+baseurl: http://127.0.0.1:8000
+moderate: true
+auth:
+  users:
+    admin:
+      password: secret
+      role: admin
+feeds:
+  short: https://example.com/short.xml
+  full:
+    url: https://example.com/full.xml
+    nick: Full
+    interval: 1h
+    template: "{{ .Title }}"
+    avatar: https://example.com/avatar.png
+    disabled: true
+`)
+
+	conf, err := LoadConfig(fn)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := map[string]FeedConfig{
+		"short": {URL: "https://example.com/short.xml"},
+		"full": {
+			URL:      "https://example.com/full.xml",
+			Nick:     "Full",
+			Interval: time.Hour,
+			Template: "{{ .Title }}",
+			Avatar:   "https://example.com/avatar.png",
+			Disabled: true,
+		},
+	}
+	if !reflect.DeepEqual(conf.Feeds, want) {
+		t.Errorf("feeds = %+v, want %+v", conf.Feeds, want)
+	}
+	if !conf.Moderate || !conf.Auth.HasAdmin() {
+		t.Error("moderation and auth were not loaded")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			"moderate without admin",
+			"moderate: true\n",
+			"moderate requires an admin",
+		},
+		{
+			"feed without url",
+			"feeds:\n  a:\n    nick: a\n",
+			"feed a has no url",
+		},
+		{
+			"invalid nick",
+			"feeds:\n  a:\n    url: https://example.com/a.xml\n    nick: a b\n",
+			"invalid nick for a",
+		},
+		{
+			"invalid template",
+			"feeds:\n  a:\n    url: https://example.com/a.xml\n    template: \"{{ .Title \"\n",
+			"error parsing template for a",
+		},
+		{
+			"short interval",
+			"interval: 10s\n",
+			"interval must be at least 1m",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := LoadConfig(writeConfig(t, test.config))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestFeedConfigYAML(t *testing.T) {
+	feeds := map[string]FeedConfig{
+		"short": {URL: "https://example.com/short.xml"},
+		"full": {
+			URL:      "https://example.com/full.xml",
+			Nick:     "Full",
+			Interval: 90 * time.Minute,
+			Template: "{{ .Title }}",
+			Disabled: true,
+		},
+	}
+
+	data, err := yaml.Marshal(feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Feeds with only a url keep the short form of old configs
+	if !strings.Contains(string(data), "short: https://example.com/short.xml\n") {
+		t.Errorf("short feed was not marshaled in the short form:\n%s", data)
+	}
+
+	var loaded map[string]FeedConfig
+	if err := yaml.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, feeds) {
+		t.Errorf("round-tripped feeds = %+v, want %+v", loaded, feeds)
+	}
+}
+
+func TestConfigSaveRoundTrip(t *testing.T) {
+	fn := writeConfig(t, "feeds:\n  a: https://example.com/a.xml\n")
+
+	conf, err := LoadConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.AddFeed("b", FeedConfig{URL: "https://example.com/b.xml", Nick: "Bee"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := LoadConfig(fn)
+	if err != nil {
+		t.Fatalf("error loading saved config: %s", err)
+	}
+	if !reflect.DeepEqual(reloaded.Feeds, conf.Feeds) {
+		t.Errorf("feeds = %+v, want %+v", reloaded.Feeds, conf.Feeds)
+	}
+}
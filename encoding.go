@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/rickb777/accept"
+)
+
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// supportedEncodings are the content codings feeds can be served with
+var supportedEncodings = []string{encodingBrotli, encodingGzip}
+
+// PreferredEncoding returns the supported content coding most preferred by
+// the request, or an empty string if the response should not be encoded
+func PreferredEncoding(r *http.Request) string {
+	codings, err := accept.Parse(r.Header.Get("Accept-Encoding"))
+	if err != nil {
+		return ""
+	}
+
+	for _, coding := range codings.Sorted().IfAccepted() {
+		for _, encoding := range supportedEncodings {
+			if coding.Name == encoding {
+				return encoding
+			}
+		}
+	}
+
+	return ""
+}
+
+// fileETag returns a strong ETag for a file that changes whenever the file
+// is written to
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// representationETag returns the ETag of a file served with encoding, or
+// etag itself if the file is served unencoded
+func representationETag(etag, encoding string) string {
+	if encoding == "" {
+		return etag
+	}
+	return fmt.Sprintf(`%s-%s"`, etag[:len(etag)-1], encoding)
+}
+
+func encode(data []byte, encoding string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	var w io.WriteCloser
+	switch encoding {
+	case encodingBrotli:
+		w = brotli.NewWriter(buf)
+	case encodingGzip:
+		w = gzip.NewWriter(buf)
+	default:
+		return nil, fmt.Errorf("error: unsupported encoding %q", encoding)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+type encodedFile struct {
+	etag string
+	data map[string][]byte // encoding -> encoded contents
+}
+
+// encodingCache keeps the latest encoded representations of served feeds so
+// that polling clients don't cause the same feed to be compressed repeatedly.
+// Only the current version of each file is kept.
+type encodingCache struct {
+	mu      sync.Mutex
+	entries map[string]encodedFile // filename -> encoded file
+}
+
+func newEncodingCache() *encodingCache {
+	return &encodingCache{entries: make(map[string]encodedFile)}
+}
+
+// Get returns the contents of f encoded with encoding, where etag is the
+// ETag of the current contents of f
+func (cache *encodingCache) Get(f *os.File, etag, encoding string) ([]byte, error) {
+	cache.mu.Lock()
+	entry, ok := cache.entries[f.Name()]
+	if ok && entry.etag == etag {
+		if data, ok := entry.data[encoding]; ok {
+			cache.mu.Unlock()
+			return data, nil
+		}
+	}
+	cache.mu.Unlock()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := encode(data, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	// Replace the entry of an older version of the file, keeping the other
+	// encodings of this version
+	entry, ok = cache.entries[f.Name()]
+	if !ok || entry.etag != etag {
+		entry = encodedFile{etag: etag, data: make(map[string][]byte)}
+		cache.entries[f.Name()] = entry
+	}
+	entry.data[encoding] = encoded
+
+	return encoded, nil
+}
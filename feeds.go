@@ -1,27 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/andyleap/microformats"
 	"github.com/gosimple/slug"
 	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/rss"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	avatarResolution = 60 // 60x60 px
-	rssTwtxtTemplate = "%s\t%s ⌘ [更多内容...](%s)\n"
+	maxRedirects     = 10
+	maxFeedProbes    = 5 // maximum number of urls tested when discovering feeds
 )
 
 var (
-	ErrNoSuitableFeedsFound = errors.New("error: no suitable RSS or Atom feeds found")
+	ErrNoSuitableFeedsFound = errors.New("error: no suitable RSS, Atom or JSON feeds found")
+
+	// discoveryTimeout limits the time spent validating a feed and
+	// discovering the feeds of a web page, all requests included
+	discoveryTimeout = time.Second * 15
 )
 
 // Feed ...
@@ -30,105 +43,423 @@ type Feed struct {
 	URL  string
 
 	LastModified string
+	Twts         int
+
+	Disabled bool
+	Failures int
 }
 
-func TestFeed(url string) (*gofeed.Feed, error) {
-	fp := gofeed.NewParser()
-	feed, err := fp.ParseURL(url)
+func TestFeed(conf *Config, url string) (*gofeed.Feed, error) {
+	return testFeed(context.Background(), conf, url)
+}
+
+func testFeed(ctx context.Context, conf *Config, url string) (*gofeed.Feed, error) {
+	res, err := GetContext(ctx, conf, url)
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
-	return feed, nil
+	return NewParser().Parse(LimitReader(res.Body, conf.HTTP.MaxFeedSize))
+}
+
+// feedTypes ranks the advertised alternate types, lower is preferred. Older
+// JSON Feeds are advertised as application/json.
+var feedTypes = map[string]int{
+	"application/atom+xml":  0,
+	"application/rss+xml":   1,
+	"application/feed+json": 2,
+	"application/json":      3,
+}
+
+// commonFeedPaths are probed on sites that don't advertise any feeds
+var commonFeedPaths = []string{
+	"/feed",
+	"/rss.xml",
+	"/atom.xml",
+	"/index.xml",
+	"/feed.json",
+}
+
+// FeedCandidate is a feed discovered on a web page
+type FeedCandidate struct {
+	URL   string `json:"url"`
+	Title string `json:"title"`
+	Type  string `json:"type,omitempty"`
+
+	feed *gofeed.Feed
+}
+
+// MultipleFeedsError is returned by ValidateFeed when a page links to more
+// than one feed and the caller has to choose one of the candidates
+type MultipleFeedsError struct {
+	Candidates []FeedCandidate
+}
+
+func (e *MultipleFeedsError) Error() string {
+	return fmt.Sprintf("error: found %d feeds, choose one", len(e.Candidates))
+}
+
+// FindFeeds returns the valid feeds advertised by the web page at uri ranked
+// Atom, RSS then JSON Feed. If the page doesn't advertise any feeds a few
+// common feed paths of the site are probed instead. Discovery gives up after
+// discoveryTimeout.
+func FindFeeds(conf *Config, uri string) ([]FeedCandidate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+
+	return findFeeds(ctx, conf, uri)
 }
 
-func FindFeed(uri string) (*gofeed.Feed, string, error) {
+func findFeeds(ctx context.Context, conf *Config, uri string) ([]FeedCandidate, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
-	res, err := http.Get(u.String())
+	res, err := GetContext(ctx, conf, u.String())
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 	defer res.Body.Close()
 
 	p := microformats.New()
-	data := p.Parse(res.Body, u)
+	data := p.Parse(LimitReader(res.Body, conf.HTTP.MaxFeedSize), u)
 
-	altMap := make(map[string]string)
+	var alternates []*microformats.AlternateRel
 	for _, alt := range data.Alternates {
-		altMap[alt.Type] = alt.URL
+		if _, ok := feedTypes[strings.ToLower(alt.Type)]; ok {
+			alternates = append(alternates, alt)
+		}
+	}
+	sort.SliceStable(alternates, func(i, j int) bool {
+		return feedTypes[strings.ToLower(alternates[i].Type)] < feedTypes[strings.ToLower(alternates[j].Type)]
+	})
+
+	var urls, types []string
+	seen := make(map[string]bool)
+	for _, alt := range alternates {
+		if seen[alt.URL] || !isHTTPURL(alt.URL) {
+			continue
+		}
+		seen[alt.URL] = true
+		urls = append(urls, alt.URL)
+		types = append(types, strings.ToLower(alt.Type))
 	}
 
-	feedURL := altMap["application/atom+xml"]
+	if len(urls) == 0 {
+		for _, path := range commonFeedPaths {
+			probe, _ := u.Parse(path)
+			urls = append(urls, probe.String())
+			types = append(types, "")
+		}
+	}
 
-	if feedURL == "" {
-		for _, alt := range data.Alternates {
-			switch alt.Type {
-			case "application/atom+xml", "application/rss+xml":
-				feedURL = alt.URL
-				break
-			}
+	// Each url is fetched, so only test the best ranked ones
+	if len(urls) > maxFeedProbes {
+		log.Warnf("only testing %d of %d feeds advertised by %s", maxFeedProbes, len(urls), uri)
+		urls = urls[:maxFeedProbes]
+	}
+
+	var candidates []FeedCandidate
+	for i, feedURL := range urls {
+		if ctx.Err() != nil {
+			log.Warnf("gave up testing the feeds of %s after %s", uri, discoveryTimeout)
+			break
+		}
+
+		feed, err := testFeed(ctx, conf, feedURL)
+		if err != nil {
+			log.WithError(err).Debugf("invalid feed candidate %s", feedURL)
+			continue
 		}
+
+		candidates = append(candidates, FeedCandidate{
+			URL:   feedURL,
+			Title: feed.Title,
+			Type:  types[i],
+			feed:  feed,
+		})
 	}
 
-	if feedURL == "" {
-		return nil, "", ErrNoSuitableFeedsFound
+	if len(candidates) == 0 {
+		return nil, ErrNoSuitableFeedsFound
 	}
 
-	feed, err := TestFeed(feedURL)
+	return candidates, nil
+}
+
+// isHTTPURL reports whether uri is an absolute http(s) url
+func isHTTPURL(uri string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// FindFeed returns the best ranked feed found on the web page at uri
+func FindFeed(conf *Config, uri string) (*gofeed.Feed, string, error) {
+	candidates, err := FindFeeds(conf, uri)
 	if err != nil {
 		return nil, "", err
 	}
 
-	return feed, feedURL, nil
+	return candidates[0].feed, candidates[0].URL, nil
 }
 
-// ValidateFeed ...
+// ValidateFeed checks that url is a feed or a web page linking to a single
+// feed and returns it named after its title. If the page links to several
+// feeds a *MultipleFeedsError listing the candidates is returned. It gives
+// up after discoveryTimeout.
 func ValidateFeed(conf *Config, url string) (Feed, error) {
-	feed, err := TestFeed(url)
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+
+	feed, err := testFeed(ctx, conf, url)
 	if err != nil {
 		log.WithError(err).Warnf("invalid feed %s", url)
 	}
 
 	if feed == nil {
-		feed, url, err = FindFeed(url)
+		candidates, err := findFeeds(ctx, conf, url)
 		if err != nil {
 			log.WithError(err).Errorf("no feed found on %s", url)
 			return Feed{}, err
 		}
+		if len(candidates) > 1 {
+			return Feed{}, &MultipleFeedsError{Candidates: candidates}
+		}
+		feed, url = candidates[0].feed, candidates[0].URL
 	}
 
+	// The avatar is downloaded by the first update once the feed's final
+	// name is known
 	name := slug.Make(feed.Title)
 
-	if feed.Image != nil && feed.Image.URL != "" {
-		opts := &ImageOptions{
-			Resize:  true,
-			ResizeW: avatarResolution,
-			ResizeH: avatarResolution,
-		}
+	return Feed{Name: name, URL: url}, nil
+}
 
-		filename := fmt.Sprintf("%s.png", name)
+// rssTranslator extends the default RSS translator preserving the <ttl>
+// element which is otherwise dropped from the universal feed
+type rssTranslator struct {
+	gofeed.DefaultRSSTranslator
+}
+
+func (t *rssTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	result, err := t.DefaultRSSTranslator.Translate(feed)
+	if err != nil {
+		return nil, err
+	}
 
-		if err := DownloadImage(conf, feed.Image.URL, filename, opts); err != nil {
-			log.WithError(err).Warnf("error downloading feed image from %s", feed.Image.URL)
+	if rss, ok := feed.(*rss.Feed); ok && rss.TTL != "" {
+		if result.Custom == nil {
+			result.Custom = make(map[string]string)
 		}
+		result.Custom["ttl"] = rss.TTL
 	}
 
-	return Feed{Name: name, URL: url}, nil
+	return result, nil
+}
+
+// FeedParser parses RSS, Atom and JSON feeds into a universal feed
+type FeedParser struct {
+	*gofeed.Parser
 }
 
-func UpdateFeed(conf *Config, name, url string) error {
+// NewParser returns a feed parser
+func NewParser() *FeedParser {
 	fp := gofeed.NewParser()
-	feed, err := fp.ParseURL(url)
+	fp.RSSTranslator = &rssTranslator{}
+	return &FeedParser{fp}
+}
+
+// Parse parses the feed read from r detecting JSON Feeds by their content
+func (fp *FeedParser) Parse(r io.Reader) (*gofeed.Feed, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsJSONFeed(data) {
+		return ParseJSONFeed(data)
+	}
+	return fp.Parser.Parse(bytes.NewReader(data))
+}
+
+// FeedTTL returns the update interval advertised by the feed via the RSS
+// <ttl> element or the syndication module, or zero if none is advertised.
+func FeedTTL(feed *gofeed.Feed) time.Duration {
+	if ttl, err := strconv.Atoi(feed.Custom["ttl"]); err == nil && ttl > 0 {
+		return time.Duration(ttl) * time.Minute
+	}
+
+	sy, ok := feed.Extensions["sy"]
+	if !ok {
+		return 0
+	}
+
+	var period time.Duration
+	if exts := sy["updatePeriod"]; len(exts) > 0 {
+		switch strings.TrimSpace(exts[0].Value) {
+		case "hourly":
+			period = time.Hour
+		case "daily":
+			period = time.Hour * 24
+		case "weekly":
+			period = time.Hour * 24 * 7
+		case "monthly":
+			period = time.Hour * 24 * 30
+		case "yearly":
+			period = time.Hour * 24 * 365
+		}
+	}
+	if period == 0 {
+		return 0
+	}
+
+	frequency := 1
+	if exts := sy["updateFrequency"]; len(exts) > 0 {
+		if n, err := strconv.Atoi(strings.TrimSpace(exts[0].Value)); err == nil && n > 0 {
+			frequency = n
+		}
+	}
+
+	return period / time.Duration(frequency)
+}
+
+// FetchFeed fetches and parses the feed at url, sending conditional request
+// headers based on the validators recorded in state and updating them from
+// the response. A nil feed is returned if the feed has not been modified.
+func FetchFeed(conf *Config, url string, state *State) (*gofeed.Feed, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
+		return nil, err
+	}
+
+	if state.ETag != "" {
+		req.Header.Set("If-None-Match", state.ETag)
+	}
+	if state.LastModified != "" {
+		req.Header.Set("If-Modified-Since", state.LastModified)
+	}
+
+	// The feed has only moved if every redirect followed is permanent
+	permanent := true
+
+	client := *conf.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		switch req.Response.StatusCode {
+		case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+		default:
+			permanent = false
+		}
+		return nil
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	state.Health.LastStatus = res.StatusCode
+
+	if finalURL := res.Request.URL.String(); finalURL != url && permanent {
+		state.RecordRedirect(finalURL)
+	} else {
+		state.RecordRedirect("")
+	}
+
+	if res.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, gofeed.HTTPError{
+			StatusCode: res.StatusCode,
+			Status:     res.Status,
+		}
+	}
+
+	feed, err := NewParser().Parse(LimitReader(res.Body, conf.HTTP.MaxFeedSize))
+	if err != nil {
+		return nil, err
+	}
+
+	state.ETag = res.Header.Get("ETag")
+	state.LastModified = res.Header.Get("Last-Modified")
+
+	return feed, nil
+}
+
+// UpdateFeed polls the feed and appends any new items to the named twtxt
+// feed, recording the outcome and scheduling the next poll in its state.
+func UpdateFeed(conf *Config, name string, feedConf FeedConfig) error {
+	unlock := conf.LockFeed(name)
+	defer unlock()
+
+	// The feed may have been deleted or renamed while waiting for the lock,
+	// possibly by the cli before the config was reloaded
+	if _, ok := conf.GetFeed(name); !ok || conf.removedFromFile(name) {
+		return ErrFeedNotFound
+	}
+
+	defer conf.Index().Refresh(conf, name)
+
+	state, err := LoadState(conf, name)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	if err := updateFeed(conf, name, feedConf, state, now); err != nil {
+		// Discard the validators so items that weren't written are retried,
+		// but keep the items that were so they aren't written again
+		written := state
+		state, serr := LoadState(conf, name)
+		if serr != nil {
+			return serr
+		}
+		state.Seen = written.Seen
+		state.Health.ItemsEmitted = written.Health.ItemsEmitted
+
+		state.Health.Record(err, now)
+		state.Schedule(conf, feedConf, now)
+		if serr := state.Save(); serr != nil {
+			log.WithError(serr).Errorf("error saving state for %s", name)
+		}
 		return err
 	}
 
+	state.Health.Record(nil, now)
+	state.Schedule(conf, feedConf, now)
+	return state.Save()
+}
+
+func updateFeed(conf *Config, name string, feedConf FeedConfig, state *State, now time.Time) error {
+	url := feedConf.URL
+
+	feed, err := FetchFeed(conf, url, state)
+	if err != nil {
+		return err
+	}
+
+	if feed == nil {
+		log.WithField("name", name).WithField("url", url).Debug("feed not modified")
+		return nil
+	}
+
+	state.TTL = FeedTTL(feed)
+
+	avatarURL := feedConf.Avatar
+	if avatarURL == "" && feed.Image != nil {
+		avatarURL = feed.Image.URL
+	}
+
 	avatarFile := filepath.Join(conf.Root, fmt.Sprintf("%s.png", name))
-	if feed.Image != nil && feed.Image.URL != "" && !Exists(avatarFile) {
+	if avatarURL != "" && !Exists(avatarFile) {
 		opts := &ImageOptions{
 			Resize:  true,
 			ResizeW: avatarResolution,
@@ -137,18 +468,31 @@ func UpdateFeed(conf *Config, name, url string) error {
 
 		filename := fmt.Sprintf("%s.png", name)
 
-		if err := DownloadImage(conf, feed.Image.URL, filename, opts); err != nil {
-			log.WithError(err).Warnf("error downloading feed image from %s", feed.Image.URL)
+		if err := DownloadImage(conf, avatarURL, filename, opts); err != nil {
+			log.WithError(err).Warnf("error downloading feed image from %s", avatarURL)
 		}
 	}
 
-	var lastModified = time.Time{}
+	tmpl, err := ParseTwtTemplate(name, conf.TwtTemplate(feedConf))
+	if err != nil {
+		return err
+	}
 
 	fn := filepath.Join(conf.Root, fmt.Sprintf("%s.txt", name))
 
-	stat, err := os.Stat(fn)
-	if err == nil {
-		lastModified = stat.ModTime()
+	// Feeds created before the seen-items index existed have no state yet,
+	// so seed the index from items already written to the feed to avoid
+	// emitting duplicates on the first update.
+	var seedBefore *time.Time
+	if len(state.Seen) == 0 {
+		if stat, err := os.Stat(fn); err == nil {
+			modTime := stat.ModTime()
+			seedBefore = &modTime
+		}
+	}
+
+	if err := WriteMetadata(fn, FeedMetadata(conf, name, feedConf, feed)); err != nil {
+		return err
 	}
 
 	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
@@ -159,30 +503,62 @@ func UpdateFeed(conf *Config, name, url string) error {
 
 	old, new := 0, 0
 	for _, item := range feed.Items {
-		if item.PublishedParsed == nil {
+		key := ItemKey(item)
+
+		if !state.IsNew(key) {
+			old++
+			state.MarkSeen(key, now)
 			continue
 		}
 
-		if item.PublishedParsed.After(lastModified) {
-			new++
-			text := fmt.Sprintf(
-				rssTwtxtTemplate,
-				item.PublishedParsed.Format(time.RFC3339),
-				item.Title,
-				item.Link,
-			)
-			_, err := f.WriteString(text)
-			if err != nil {
-				return err
-			}
-		} else {
+		published := ItemTime(item, now)
+
+		if seedBefore != nil && !published.After(*seedBefore) {
 			old++
+			state.MarkSeen(key, now)
+			continue
+		}
+
+		text, err := RenderTwt(tmpl, name, feed, item)
+		if err != nil {
+			// Marked as seen so the item isn't retried and logged on every
+			// poll, such as when the template uses a field it doesn't have
+			log.WithError(err).Warnf("skipping item %s for %s which failed to render", key, name)
+			state.MarkSeen(key, now)
+			continue
 		}
+
+		if text == "" {
+			log.Warnf("skipping item %s for %s which rendered as empty twt", key, name)
+			state.MarkSeen(key, now)
+			continue
+		}
+
+		if err := AppendTwt(f, text, published); err != nil {
+			return err
+		}
+		state.MarkSeen(key, now)
+		state.Health.ItemsEmitted++
+		new++
 	}
 
+	state.Prune(now.Add(-seenExpiry))
+
 	if (old + new) == 0 {
 		log.WithField("name", name).WithField("url", url).Warn("empty or bad feed")
 	}
 
 	return nil
 }
+
+// ItemTime returns the published time of an item, falling back to its
+// updated time or the given default if the feed provides neither.
+func ItemTime(item *gofeed.Item, def time.Time) time.Time {
+	if item.PublishedParsed != nil {
+		return *item.PublishedParsed
+	}
+	if item.UpdatedParsed != nil {
+		return *item.UpdatedParsed
+	}
+	return def
+}
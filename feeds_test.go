@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRSS = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Test %s</title><link>http://example.com/</link><description>test</description>
+<item><title>One</title><link>http://example.com/1</link><guid>1</guid></item>
+</channel></rss>`
+
+// newLocalConfig returns a config whose client may connect to test servers
+// on loopback addresses
+func newLocalConfig() *Config {
+	conf := newTestConfig()
+	conf.HTTP.Allow = []string{"127.0.0.1", "::1"}
+	return conf
+}
+
+func TestFindFeedsLimitsProbes(t *testing.T) {
+	const advertised = 500
+
+	var probes int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><head>")
+		for i := 0; i < advertised; i++ {
+			fmt.Fprintf(w, `<link rel="alternate" type="application/rss+xml" href="/feeds/%d.xml">`, i)
+		}
+		fmt.Fprint(w, "</head><body></body></html>")
+	})
+	mux.HandleFunc("/feeds/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+		// Only some of the advertised feeds are valid
+		if strings.HasSuffix(r.URL.Path, "/1.xml") || strings.HasSuffix(r.URL.Path, "/2.xml") {
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprintf(w, testRSS, r.URL.Path)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	candidates, err := FindFeeds(newLocalConfig(), server.URL+"/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n := atomic.LoadInt32(&probes); n > maxFeedProbes {
+		t.Errorf("tested %d urls, want at most %d", n, maxFeedProbes)
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("found %d candidates, want 2", len(candidates))
+	}
+	if candidates[0].URL != server.URL+"/feeds/1.xml" || candidates[1].URL != server.URL+"/feeds/2.xml" {
+		t.Errorf("unexpected candidates %+v", candidates)
+	}
+}
+
+func TestFindFeedsSkipsNonHTTP(t *testing.T) {
+	var probes int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head>
+<link rel="alternate" type="application/rss+xml" href="javascript:alert(1)">
+<link rel="alternate" type="application/rss+xml" href="/feed.xml">
+</head></html>`)
+	})
+	mux.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprintf(w, testRSS, "feed")
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	candidates, err := FindFeeds(newLocalConfig(), server.URL+"/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(candidates) != 1 || candidates[0].URL != server.URL+"/feed.xml" {
+		t.Errorf("unexpected candidates %+v", candidates)
+	}
+}
+
+// newFeedServer returns a server serving body as an RSS feed at /feed.xml
+func newFeedServer(t *testing.T, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newFeedConfig returns a local config with the named feed polling url
+func newFeedConfig(t *testing.T, name, url string) (*Config, FeedConfig) {
+	conf := newLocalConfig()
+	conf.Root = tempDir(t)
+
+	feed := FeedConfig{URL: url}
+	if err := conf.AddFeed(name, feed); err != nil {
+		t.Fatal(err)
+	}
+	return conf, feed
+}
+
+func TestUpdateFeedWritesItemsOnce(t *testing.T) {
+	server := newFeedServer(t, fmt.Sprintf(testRSS, "once"))
+	conf, feed := newFeedConfig(t, "test", server.URL+"/feed.xml")
+	fn := feedFile(conf, "test", "txt")
+
+	for i := 0; i < 2; i++ {
+		if err := UpdateFeed(conf, "test", feed); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if n := strings.Count(readHistory(t, fn), "One ⌘"); n != 1 {
+		t.Errorf("item written %d times, want once", n)
+	}
+
+	// The seen index survives the feed file being rotated away
+	if err := ioutil.WriteFile(fn, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateFeed(conf, "test", feed); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if data := readHistory(t, fn); strings.Contains(data, "One ⌘") {
+		t.Errorf("item written again after rotation:\n%s", data)
+	}
+}
+
+func TestUpdateFeedPrunesSeen(t *testing.T) {
+	server := newFeedServer(t, fmt.Sprintf(testRSS, "prune"))
+	conf, feed := newFeedConfig(t, "test", server.URL+"/feed.xml")
+
+	state, err := LoadState(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.MarkSeen("guid:gone", time.Now().Add(-seenExpiry-time.Hour))
+	state.MarkSeen("guid:1", time.Now().Add(-seenExpiry-time.Hour))
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateFeed(conf, "test", feed); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if state, err = LoadState(conf, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if !state.IsNew("guid:gone") {
+		t.Error("item no longer in the feed was not pruned")
+	}
+	// Items still in the feed are seen again and kept
+	if state.IsNew("guid:1") {
+		t.Error("item still in the feed was pruned")
+	}
+}
+
+func TestUpdateFeedConditional(t *testing.T) {
+	const (
+		etag         = `"v1"`
+		lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	)
+
+	var requests, notModified int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("If-None-Match") == etag && r.Header.Get("If-Modified-Since") == lastModified {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		fmt.Fprintf(w, testRSS, "conditional")
+	}))
+	defer server.Close()
+
+	conf, feed := newFeedConfig(t, "test", server.URL+"/feed.xml")
+	fn := feedFile(conf, "test", "txt")
+
+	if err := UpdateFeed(conf, "test", feed); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	state, err := LoadState(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.ETag != etag || state.LastModified != lastModified {
+		t.Errorf("validators = %q, %q, want %q, %q", state.ETag, state.LastModified, etag, lastModified)
+	}
+
+	// Make sure the feed file isn't rewritten by the next poll
+	before := readHistory(t, fn)
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(fn, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateFeed(conf, "test", feed); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := atomic.LoadInt32(&notModified); n != 1 {
+		t.Fatalf("%d of %d requests were conditional, want 1", n, atomic.LoadInt32(&requests))
+	}
+
+	stat, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.ModTime().Equal(old) || readHistory(t, fn) != before {
+		t.Error("feed was modified after a 304 response")
+	}
+
+	if state, err = LoadState(conf, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if state.ETag != etag || state.Health.LastStatus != http.StatusNotModified || state.Health.Failures != 0 {
+		t.Errorf("unexpected state after a 304 response: %+v", state)
+	}
+}
+
+func TestUpdateFeedSkipsItemsFailingToRender(t *testing.T) {
+	server := newFeedServer(t, fmt.Sprintf(testRSS, "render"))
+	conf, feed := newFeedConfig(t, "test", server.URL+"/feed.xml")
+
+	// The item has no author
+	feed.Template = "{{ .Title }} by {{ .Author.Name }}"
+
+	if err := UpdateFeed(conf, "test", feed); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	state, err := LoadState(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.IsNew("guid:1") {
+		t.Error("item that failed to render will be retried on every poll")
+	}
+	if data := readHistory(t, feedFile(conf, "test", "txt")); strings.Contains(data, "One") {
+		t.Errorf("item that failed to render was written:\n%s", data)
+	}
+}
+
+func TestValidateFeedGivesUp(t *testing.T) {
+	defer func(timeout time.Duration) { discoveryTimeout = timeout }(discoveryTimeout)
+	discoveryTimeout = 200 * time.Millisecond
+
+	var probes int32
+	done := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><head></head><body>no feeds here</body></html>")
+	})
+	for _, path := range commonFeedPaths {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&probes, 1)
+			// Slow enough that probing every path would take far longer
+			// than the deadline
+			select {
+			case <-r.Context().Done():
+			case <-done:
+			}
+		})
+	}
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	defer close(done)
+
+	start := time.Now()
+	_, err := ValidateFeed(newLocalConfig(), server.URL+"/")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %s, want about %s", elapsed, discoveryTimeout)
+	}
+	if n := atomic.LoadInt32(&probes); n > 1 {
+		t.Errorf("probed %d paths after the deadline", n)
+	}
+}
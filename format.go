@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/mmcdole/gofeed"
+)
+
+const (
+	defaultTwtTemplate = "{{ .Title }} ⌘ [更多内容...]({{ .Link }})"
+)
+
+var (
+	htmlTags = regexp.MustCompile(`<[^>]*>`)
+
+	twtFuncs = template.FuncMap{
+		"join":     strings.Join,
+		"plain":    plainText,
+		"truncate": truncate,
+	}
+)
+
+// TwtContext is the data passed to twt templates when rendering a feed item.
+// All of the gofeed item fields (Title, Link, Description, Author,
+// Categories, Enclosures, ...) are available directly.
+type TwtContext struct {
+	*gofeed.Item
+
+	Name string
+	Feed *gofeed.Feed
+}
+
+// ParseTwtTemplate parses a twt template, using the default template if
+// tmpl is empty.
+func ParseTwtTemplate(name, tmpl string) (*template.Template, error) {
+	if tmpl == "" {
+		tmpl = defaultTwtTemplate
+	}
+	return template.New(name).Funcs(twtFuncs).Parse(tmpl)
+}
+
+// RenderTwt renders a feed item as the text of a single twt
+func RenderTwt(t *template.Template, name string, feed *gofeed.Feed, item *gofeed.Item) (string, error) {
+	ctx := TwtContext{
+		Item: item,
+		Name: name,
+		Feed: feed,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, ctx); err != nil {
+		return "", err
+	}
+
+	// A twt must fit on a single line
+	return strings.Join(strings.Fields(buf.String()), " "), nil
+}
+
+// plainText strips HTML tags and entities from s
+func plainText(s string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(htmlTags.ReplaceAllString(s, " "))), " ")
+}
+
+// truncate shortens s to at most n characters adding an ellipsis if needed
+func truncate(n int, s string) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n]) + "…"
+}
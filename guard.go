@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+var (
+	ErrForbiddenAddress = errors.New("error: destination address is not allowed")
+	ErrForbiddenScheme  = errors.New("error: only http and https urls are allowed")
+
+	// reservedNets are never fetched unless explicitly allowed: loopback,
+	// private, link-local (incl. cloud metadata), shared, documentation and
+	// reserved ranges
+	reservedNets = mustParseCIDRs(
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.0.2.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"2001:db8::/32",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	)
+
+	// NAT64, 6to4 and IPv4-compatible addresses reach the IPv4 address they
+	// embed
+	nat64Net     = mustParseCIDRs("64:ff9b::/96")[0]
+	sixToFourNet = mustParseCIDRs("2002::/16")[0]
+	v4CompatNet  = mustParseCIDRs("::/96")[0]
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// parseCIDRs parses a list of CIDRs or single IP addresses
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("error: invalid address or cidr %q", cidr)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// embeddedIPv4 returns the IPv4 address embedded in a NAT64, 6to4 or
+// IPv4-compatible address, or nil if ip embeds none
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil
+	}
+
+	switch {
+	case nat64Net.Contains(ip), v4CompatNet.Contains(ip):
+		return net.IP(ip[12:16])
+	case sixToFourNet.Contains(ip):
+		return net.IP(ip[2:6])
+	}
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Guard restricts the destinations outgoing requests may connect to so
+// that user submitted urls cannot be used to reach internal services.
+type Guard struct {
+	deny       []*net.IPNet
+	allow      []*net.IPNet
+	allowHosts map[string]bool
+}
+
+// NewGuard returns a guard denying reserved addresses and the addresses in
+// deny, except for the hosts and addresses in allow. Entries in deny and
+// allow may be IP addresses or CIDRs, allow may also contain host names.
+func NewGuard(deny, allow []string) (*Guard, error) {
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	guard := &Guard{
+		deny:       append(append([]*net.IPNet{}, reservedNets...), denyNets...),
+		allowHosts: make(map[string]bool),
+	}
+
+	for _, entry := range allow {
+		nets, err := parseCIDRs([]string{entry})
+		if err != nil {
+			guard.allowHosts[strings.ToLower(entry)] = true
+			continue
+		}
+		guard.allow = append(guard.allow, nets...)
+	}
+
+	return guard, nil
+}
+
+// AllowedIP reports whether connections to ip are allowed. Addresses
+// embedding an IPv4 address are only allowed if the IPv4 address is.
+func (guard *Guard) AllowedIP(ip net.IP) bool {
+	if containsIP(guard.allow, ip) {
+		return true
+	}
+	if containsIP(guard.deny, ip) {
+		return false
+	}
+	if v4 := embeddedIPv4(ip); v4 != nil {
+		return guard.AllowedIP(v4)
+	}
+	return true
+}
+
+// AllowedHost reports whether host is explicitly allowed
+func (guard *Guard) AllowedHost(host string) bool {
+	return guard.allowHosts[strings.ToLower(host)]
+}
+
+// CheckHost resolves host and checks that all of its addresses are allowed
+func (guard *Guard) CheckHost(ctx context.Context, host string) error {
+	if guard.AllowedHost(host) {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !guard.AllowedIP(ip) {
+			return ErrForbiddenAddress
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !guard.AllowedIP(addr.IP) {
+			return ErrForbiddenAddress
+		}
+	}
+
+	return nil
+}
+
+// DialContext wraps the given dialer checking the resolved address of every
+// connection, so the guard also applies to redirects and DNS rebinding.
+func (guard *Guard) DialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	guarded := *dialer
+	guarded.Control = func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !guard.AllowedIP(ip) {
+			return ErrForbiddenAddress
+		}
+		return nil
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if guard.AllowedHost(host) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		// Connections to the proxy of a request whose destination was
+		// checked by guardTransport are trusted
+		if proxyAddr, ok := ctx.Value(proxyAddrContextKey).(string); ok && proxyAddr == addr {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return guarded.DialContext(ctx, network, addr)
+	}
+}
+
+// proxyAddrContextKey is the context key of the address of the proxy a
+// request is sent through
+const proxyAddrContextKey contextKey = "proxy"
+
+// proxyAddr returns the host:port the transport dials to connect to the
+// proxy at u
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// guardTransport rejects requests for urls that are not http(s) and, when
+// requests are sent through a proxy (which the dialer guard cannot see
+// past), checks the destination host before sending the request. Only
+// then may the dialer connect to the proxy, even if its address is not
+// allowed.
+type guardTransport struct {
+	guard *Guard
+	proxy func(*http.Request) (*url.URL, error)
+	next  http.RoundTripper
+}
+
+func (t *guardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, ErrForbiddenScheme
+	}
+
+	proxyURL, err := t.proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		if err := t.guard.CheckHost(req.Context(), req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+		ctx := context.WithValue(req.Context(), proxyAddrContextKey, proxyAddr(proxyURL))
+		req = req.WithContext(ctx)
+	}
+
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGuardAllowedIP(t *testing.T) {
+	guard, err := NewGuard([]string{"185.199.108.0/22", "151.101.1.69"}, []string{"10.1.2.3", "192.168.10.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"185.199.109.153", false},
+		{"151.101.1.69", false},
+		{"151.101.1.70", true},
+		{"192.0.2.1", false},
+		{"198.51.100.8", false},
+		{"203.0.113.9", false},
+		{"2001:db8::1", false},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::5db8:d822", true},
+		{"2002:a00:1::1", false},
+		{"2002:5db8:d822::1", true},
+		{"::127.0.0.1", false},
+		{"::10.0.0.1", false},
+		{"::93.184.216.34", true},
+		{"64:ff9b::a01:203", true},
+		{"10.1.2.3", true},
+		{"10.1.2.4", false},
+		{"192.168.10.20", true},
+	}
+
+	for _, test := range tests {
+		if allowed := guard.AllowedIP(net.ParseIP(test.ip)); allowed != test.allowed {
+			t.Errorf("AllowedIP(%s) = %v, want %v", test.ip, allowed, test.allowed)
+		}
+	}
+}
+
+func TestGuardCheckHost(t *testing.T) {
+	guard, err := NewGuard(nil, []string{"Feeds.Internal.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		err  error
+	}{
+		{"93.184.216.34", nil},
+		{"127.0.0.1", ErrForbiddenAddress},
+		{"::1", ErrForbiddenAddress},
+		{"localhost", ErrForbiddenAddress},
+		{"feeds.internal.example", nil},
+	}
+
+	for _, test := range tests {
+		if err := guard.CheckHost(context.Background(), test.host); err != test.err {
+			t.Errorf("CheckHost(%s) = %v, want %v", test.host, err, test.err)
+		}
+	}
+}
+
+func TestNewGuardInvalid(t *testing.T) {
+	if _, err := NewGuard([]string{"not-a-cidr"}, nil); err == nil {
+		t.Error("expected error for invalid deny entry")
+	}
+	if _, err := NewGuard(nil, []string{"feeds.example.com", "10.0.0.0/8"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestProxyAddr(t *testing.T) {
+	tests := []struct {
+		proxy string
+		addr  string
+	}{
+		{"http://proxy.example.com:3128", "proxy.example.com:3128"},
+		{"http://proxy.example.com", "proxy.example.com:80"},
+		{"https://proxy.example.com", "proxy.example.com:443"},
+		{"socks5://127.0.0.1", "127.0.0.1:1080"},
+		{"http://[::1]:8080", "[::1]:8080"},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr := proxyAddr(u); addr != test.addr {
+			t.Errorf("proxyAddr(%s) = %s, want %s", test.proxy, addr, test.addr)
+		}
+	}
+}
+
+// newTestProxy returns a server on a loopback address acting as a forward
+// proxy that answers every request itself, and a counter of the requests
+// it received
+func newTestProxy(t *testing.T) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func newTestConfig() *Config {
+	conf := NewConfig()
+	conf.Timeout = 5 * time.Second
+	return conf
+}
+
+func TestClientGuardDirect(t *testing.T) {
+	server, requests := newTestProxy(t)
+
+	conf := newTestConfig()
+	_, err := Get(conf, server.URL)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("expected ErrForbiddenAddress, got %v", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 0 {
+		t.Errorf("server received %d requests", n)
+	}
+}
+
+func TestClientGuardProxy(t *testing.T) {
+	proxy, requests := newTestProxy(t)
+
+	conf := newTestConfig()
+	conf.HTTP.Proxy = proxy.URL
+
+	// Public destinations are sent through the proxy on a loopback address
+	res, err := Get(conf, "http://93.184.216.34/feed.xml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	res.Body.Close()
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("proxy received %d requests, want 1", n)
+	}
+
+	// but the proxy itself and other reserved destinations are not
+	for _, uri := range []string{proxy.URL + "/", "http://127.0.0.1:6379/", "http://169.254.169.254/latest/meta-data/"} {
+		if _, err := Get(conf, uri); !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("Get(%s): expected ErrForbiddenAddress, got %v", uri, err)
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("proxy received %d requests, want 1", n)
+	}
+}
+
+func TestClientGuardProxyBypass(t *testing.T) {
+	proxy, requests := newTestProxy(t)
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Like http.ProxyFromEnvironment, loopback destinations are not proxied
+	proxyFunc := func(req *http.Request) (*url.URL, error) {
+		if ip := net.ParseIP(req.URL.Hostname()); ip != nil && ip.IsLoopback() {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+
+	guard, err := NewGuard(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newHTTPClient(newTestConfig(), guard, proxyFunc)
+
+	// A direct request to the proxy's own address is still guarded
+	if _, err := client.Get(proxy.URL + "/"); !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("expected ErrForbiddenAddress, got %v", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 0 {
+		t.Errorf("proxy received %d requests, want 0", n)
+	}
+
+	res, err := client.Get("http://93.184.216.34/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	res.Body.Close()
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("proxy received %d requests, want 1", n)
+	}
+}
+
+func TestClientForbiddenScheme(t *testing.T) {
+	if _, err := Get(newTestConfig(), "file:///etc/passwd"); !errors.Is(err, ErrForbiddenScheme) {
+		t.Errorf("expected ErrForbiddenScheme, got %v", err)
+	}
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"html/template"
 	"image/png"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/aofei/cameron"
@@ -80,15 +84,39 @@ func (app *App) IndexHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		feed, err := ValidateFeed(app.conf, url)
+		if multiple, ok := err.(*MultipleFeedsError); ok {
+			ctx := struct {
+				Title      string
+				URL        string
+				Candidates []FeedCandidate
+			}{
+				Title:      "选择 Feed 源",
+				URL:        url,
+				Candidates: multiple.Candidates,
+			}
+
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err := render("choose", chooseTemplate, ctx, w); err != nil {
+				log.WithError(err).Error("error rendering choose template")
+				http.Error(w, Msg500, http.StatusInternalServerError)
+			}
+			return
+		}
 		if err != nil {
-			if err := renderMessage(w, http.StatusBadRequest, "错误", fmt.Sprintf("不能找到有效的 RSS/Atom 源: %s", url)); err != nil {
+			if err := renderMessage(w, http.StatusBadRequest, "错误", fmt.Sprintf("不能找到有效的 RSS/Atom/JSON Feed 源: %s", url)); err != nil {
 				log.WithError(err).Error("error rendering message template")
 				http.Error(w, Msg500, http.StatusInternalServerError)
 			}
 			return
 		}
 
-		if _, ok := app.conf.Feeds[feed.Name]; ok {
+		pending := app.needsModeration(r)
+		if pending {
+			err = app.conf.AddPending(feed.Name, FeedConfig{URL: feed.URL})
+		} else {
+			err = app.conf.AddFeed(feed.Name, FeedConfig{URL: feed.URL})
+		}
+		if err == ErrFeedExists {
 			if err := renderMessage(w, http.StatusConflict, "错误", "Feed 源已经存在"); err != nil {
 				log.WithError(err).Error("error rendering message template")
 				http.Error(w, Msg500, http.StatusInternalServerError)
@@ -96,7 +124,6 @@ func (app *App) IndexHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		app.conf.Feeds[feed.Name] = feed.URL
 		if err := app.conf.Save(); err != nil {
 			msg := fmt.Sprintf("不能保存 Feed: %s", err)
 			if err := renderMessage(w, http.StatusInternalServerError, "错误", msg); err != nil {
@@ -107,6 +134,9 @@ func (app *App) IndexHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		msg := fmt.Sprintf("添加 [%s](%s) Feed 源成功", feed.Name, feed.URL)
+		if pending {
+			msg = fmt.Sprintf("已提交 [%s](%s) Feed 源，审核通过后将会添加", feed.Name, feed.URL)
+		}
 		if err := renderMessage(w, http.StatusCreated, "成功", msg); err != nil {
 			log.WithError(err).Error("error rendering message template")
 			http.Error(w, Msg500, http.StatusInternalServerError)
@@ -118,8 +148,6 @@ func (app *App) IndexHandler(w http.ResponseWriter, r *http.Request) {
 
 func (app *App) FeedHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodHead || r.Method == http.MethodGet {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-
 		vars := mux.Vars(r)
 
 		name := vars["name"]
@@ -128,6 +156,10 @@ func (app *App) FeedHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if app.redirectRenamed(w, r, name) {
+			return
+		}
+
 		filename := filepath.Join(app.conf.Root, fmt.Sprintf("%s.txt", name))
 		if !Exists(filename) {
 			log.Warnf("feed does not exist %s", name)
@@ -135,25 +167,123 @@ func (app *App) FeedHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		fileInfo, err := os.Stat(filename)
+		f, err := os.Open(filename)
+		if err != nil {
+			log.WithError(err).Error("error opening feed file")
+			http.Error(w, Msg500, http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		fileInfo, err := f.Stat()
 		if err != nil {
 			log.WithError(err).Error("os.Stat() error")
 			http.Error(w, Msg500, http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+		w.Header().Set("Cache-Control", "public, no-cache")
+		w.Header().Set("Vary", "Accept-Encoding")
+
+		// Range requests are used to fetch only new twts, so they are always
+		// served from the unencoded feed
+		encoding := ""
+		if r.Header.Get("Range") == "" {
+			encoding = PreferredEncoding(r)
+		}
 
-		if r.Method == http.MethodHead {
+		// The ETag identifies the representation actually served, so that
+		// validators from an encoded response never match the unencoded feed
+		etag := fileETag(fileInfo)
+		w.Header().Set("ETag", representationETag(etag, encoding))
+
+		if encoding == "" {
+			// Handles If-None-Match, If-Modified-Since, Range and HEAD
+			http.ServeContent(w, r, filename, fileInfo.ModTime(), f)
 			return
 		}
 
-		http.ServeFile(w, r, filename)
+		data, err := app.encoded.Get(f, etag, encoding)
+		if err != nil {
+			log.WithError(err).Errorf("error encoding feed %s", name)
+			http.Error(w, Msg500, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", encoding)
+		http.ServeContent(w, r, filename, fileInfo.ModTime(), bytes.NewReader(data))
 		return
 	}
 	http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
 }
 
+// ArchiveHandler serves the archived segments of a feed linked from its
+// `# prev` header
+func (app *App) ArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	name := vars["name"]
+	n, err := strconv.ParseInt(vars["n"], 10, 64)
+	if name == "" || err != nil {
+		http.Error(w, "错误请求", http.StatusBadRequest)
+		return
+	}
+
+	if app.redirectRenamed(w, r, name) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// Archived segments only change when the link to older segments is
+	// removed as they are pruned
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+
+	filename := ArchiveFile(app.conf, name, n)
+	if Exists(filename) {
+		http.ServeFile(w, r, filename)
+		return
+	}
+
+	// Archives may have been compressed by the retention policy
+	filename += ".gz"
+	if !Exists(filename) {
+		w.Header().Del("Cache-Control")
+		http.Error(w, "Feed 没有找到", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	if accept.AcceptsEncoding(r.Header, encodingGzip) {
+		w.Header().Set("Content-Encoding", "gzip")
+		http.ServeFile(w, r, filename)
+		return
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		log.WithError(err).Error("error opening archive file")
+		http.Error(w, Msg500, http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		log.WithError(err).Error("error reading archive file")
+		http.Error(w, Msg500, http.StatusInternalServerError)
+		return
+	}
+	defer zr.Close()
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if _, err := io.Copy(w, zr); err != nil {
+		log.WithError(err).Error("error writing archive response")
+	}
+}
+
 func (app *App) AvatarHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodHead || r.Method == http.MethodGet {
 		w.Header().Set("Content-Type", "image/png")
@@ -167,6 +297,10 @@ func (app *App) AvatarHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if app.redirectRenamed(w, r, name) {
+			return
+		}
+
 		filename := filepath.Join(app.conf.Root, fmt.Sprintf("%s.txt", name))
 		if !Exists(filename) {
 			log.Warnf("feed does not exist %s", name)
@@ -292,3 +426,84 @@ func (app *App) FeedsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
 }
+
+func (app *App) PendingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	var feeds []Feed
+	for name, feed := range app.conf.AllPending() {
+		feeds = append(feeds, Feed{Name: name, URL: feed.URL})
+	}
+	sort.Slice(feeds, func(i, j int) bool { return feeds[i].Name < feeds[j].Name })
+
+	ctx := struct {
+		Title string
+		Feeds []Feed
+	}{
+		Title: "待审核的 Feed 源",
+		Feeds: feeds,
+	}
+
+	if err := render("pending", pendingTemplate, ctx, w); err != nil {
+		log.WithError(err).Error("error rendering pending template")
+		http.Error(w, Msg500, http.StatusInternalServerError)
+	}
+}
+
+func (app *App) ModerateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	name := vars["name"]
+	action := vars["action"]
+
+	switch action {
+	case "approve":
+		feed, err := app.conf.ApprovePending(name)
+		if err == ErrFeedNotFound {
+			http.Error(w, "Feed 没有找到", http.StatusNotFound)
+			return
+		}
+		if err == ErrFeedExists {
+			http.Error(w, "Feed 源已经存在", http.StatusConflict)
+			return
+		}
+		log.Infof("approved feed %s: %s", name, feed.URL)
+	case "reject":
+		feed, err := app.conf.RejectPending(name)
+		if err != nil {
+			http.Error(w, "Feed 没有找到", http.StatusNotFound)
+			return
+		}
+		log.Infof("rejected feed %s: %s", name, feed.URL)
+	default:
+		http.Error(w, "错误请求", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.conf.Save(); err != nil {
+		log.WithError(err).Error("error saving config")
+		http.Error(w, Msg500, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/pending", http.StatusFound)
+}
+
+// needsModeration reports whether feeds submitted by the request must be
+// queued for review before going live
+func (app *App) needsModeration(r *http.Request) bool {
+	return app.conf.IsModerated() && !RoleFromContext(r.Context()).Has(RoleAdmin)
+}
+
+// redirectRenamed permanently redirects requests for the files of a renamed
+// feed to the same files under the feed's new name
+func (app *App) redirectRenamed(w http.ResponseWriter, r *http.Request, name string) bool {
+	to, ok := app.conf.Redirect(name)
+	if !ok {
+		return false
+	}
+
+	target := fmt.Sprintf("/%s%s", url.PathEscape(to), strings.TrimPrefix(r.URL.Path, fmt.Sprintf("/%s", name)))
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+	return true
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestRenderEscapes(t *testing.T) {
+	const (
+		payload = `"><script>alert(1)</script>`
+		evilURL = `http://example.com/feed.xml?` + payload
+	)
+
+	feeds := struct {
+		Title string
+		Feeds []Feed
+	}{
+		Title: "feeds",
+		Feeds: []Feed{{Name: "evil", URL: evilURL}},
+	}
+
+	choose := struct {
+		Title      string
+		URL        string
+		Candidates []FeedCandidate
+	}{
+		Title: "choose",
+		URL:   evilURL,
+		Candidates: []FeedCandidate{
+			{URL: evilURL, Title: payload, Type: "application/rss+xml"},
+			{URL: "javascript:alert(1)", Title: "js"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		tmpl string
+		ctx  interface{}
+	}{
+		{"feeds", feedsTemplate, feeds},
+		{"pending", pendingTemplate, feeds},
+		{"choose", chooseTemplate, choose},
+		{"message", messageTemplate, struct{ Title, Message string }{payload, payload}},
+	}
+
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		if err := render(test.name, test.tmpl, test.ctx, buf); err != nil {
+			t.Fatalf("%s: error rendering: %s", test.name, err)
+		}
+
+		html := buf.String()
+		if strings.Contains(html, payload) || strings.Contains(html, "<script>") {
+			t.Errorf("%s: payload was not escaped:\n%s", test.name, html)
+		}
+		if strings.Contains(html, `href="javascript:`) {
+			t.Errorf("%s: javascript url was not sanitized", test.name)
+		}
+	}
+}
+
+func TestIsHTTPURL(t *testing.T) {
+	tests := []struct {
+		uri string
+		ok  bool
+	}{
+		{"http://example.com/feed.xml", true},
+		{"https://example.com/feed.xml", true},
+		{"javascript:alert(1)", false},
+		{"data:text/html,<script>", false},
+		{"file:///etc/passwd", false},
+		{"/feed.xml", false},
+		{"http://", false},
+	}
+
+	for _, test := range tests {
+		if ok := isHTTPURL(test.uri); ok != test.ok {
+			t.Errorf("isHTTPURL(%q) = %v, want %v", test.uri, ok, test.ok)
+		}
+	}
+}
+
+func TestSubmitModerated(t *testing.T) {
+	server := newFeedServer(t, fmt.Sprintf(testRSS, "submitted"))
+
+	tests := []struct {
+		name     string
+		moderate bool
+		allowed  bool
+		pending  int
+	}{
+		{"moderated", true, true, 1},
+		{"unmoderated", false, false, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fn := writeConfig(t, fmt.Sprintf(`
+root: %s
+moderate: %t
+auth:
+  users:
+    admin:
+      password: secret
+      role: admin
+http:
+  allow: ["127.0.0.1"]
+`, tempDir(t), test.moderate))
+
+			app, err := NewApp("127.0.0.1:0", fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			form := url.Values{"url": {server.URL + "/feed.xml"}}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			app.initRoutes().ServeHTTP(w, req)
+
+			if allowed := w.Code != http.StatusUnauthorized; allowed != test.allowed {
+				t.Errorf("anonymous submission allowed = %t, want %t", allowed, test.allowed)
+			}
+			if n := len(app.conf.AllPending()); n != test.pending {
+				t.Errorf("%d feeds pending, want %d", n, test.pending)
+			}
+			if n := len(app.conf.AllFeeds()); n != 0 {
+				t.Errorf("%d feeds added without review", n)
+			}
+		})
+	}
+}
+
+func TestFeedHandler(t *testing.T) {
+	root := tempDir(t)
+	fn := writeConfig(t, fmt.Sprintf("root: %s\n", root))
+
+	app, err := NewApp("127.0.0.1:0", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := app.initRoutes()
+
+	feed := filepath.Join(root, "test.txt")
+	body := "2020-01-01T00:00:00Z\tOne\n2020-01-02T00:00:00Z\tTwo\n"
+	if err := ioutil.WriteFile(feed, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := fileETag(info)
+
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/test/twtxt.txt", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	decode := func(encoding string, data []byte) string {
+		var r io.Reader = bytes.NewReader(data)
+		switch encoding {
+		case encodingGzip:
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = zr
+		case encodingBrotli:
+			r = brotli.NewReader(r)
+		}
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(decoded)
+	}
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		status   int
+		etag     string
+		encoding string
+		body     string
+	}{
+		{"identity", nil, http.StatusOK, etag, "", body},
+		{"gzip", map[string]string{"Accept-Encoding": "gzip"}, http.StatusOK, representationETag(etag, "gzip"), "gzip", body},
+		{"brotli", map[string]string{"Accept-Encoding": "gzip;q=0.5, br"}, http.StatusOK, representationETag(etag, "br"), "br", body},
+		{
+			"not modified",
+			map[string]string{"Accept-Encoding": "gzip", "If-None-Match": representationETag(etag, "gzip")},
+			http.StatusNotModified, representationETag(etag, "gzip"), "", "",
+		},
+		{
+			"other representation",
+			map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etag},
+			http.StatusOK, representationETag(etag, "gzip"), "gzip", body,
+		},
+		{
+			"range",
+			map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=27-"},
+			http.StatusPartialContent, etag, "", body[27:],
+		},
+		{
+			"range not modified",
+			map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=27-", "If-None-Match": etag},
+			http.StatusNotModified, etag, "", "",
+		},
+		{
+			"range of encoded representation",
+			map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=27-", "If-Range": representationETag(etag, "gzip")},
+			http.StatusOK, etag, "", body,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := get(test.headers)
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d", w.Code, test.status)
+			}
+			if got := w.Header().Get("ETag"); got != test.etag {
+				t.Errorf("got ETag %s, want %s", got, test.etag)
+			}
+			if w.Code == http.StatusNotModified {
+				return
+			}
+			if got := w.Header().Get("Content-Encoding"); got != test.encoding {
+				t.Errorf("got Content-Encoding %q, want %q", got, test.encoding)
+			}
+			if got := decode(test.encoding, w.Body.Bytes()); got != test.body {
+				t.Errorf("got body %q, want %q", got, test.body)
+			}
+		})
+	}
+
+	// Rewriting the feed replaces its cached encodings
+	body += "2020-01-03T00:00:00Z\tThree\n"
+	if err := ioutil.WriteFile(feed, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := get(map[string]string{"Accept-Encoding": "gzip"})
+	if got := decode(encodingGzip, w.Body.Bytes()); got != body {
+		t.Errorf("got body %q after rewriting the feed, want %q", got, body)
+	}
+	if n := len(app.encoded.entries); n != 1 {
+		t.Errorf("%d feeds cached, want 1", n)
+	}
+	if n := len(app.encoded.entries[feed].data); n != 1 {
+		t.Errorf("%d encodings cached after rewriting the feed, want 1", n)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FeedStats are the statistics of a generated twtxt feed kept in the index
+type FeedStats struct {
+	Size    int64     // size of the feed file in bytes
+	ModTime time.Time // last time the feed file was written
+	Twts    int       // number of twts in the feed file
+	LastTwt time.Time // timestamp of the most recent twt
+
+	Failures int // consecutive failed updates
+}
+
+// FeedIndex is an in-memory index of the generated feeds so that listings
+// don't have to walk the feeds directory. It is updated whenever a feed is
+// updated, rotated, renamed or deleted.
+type FeedIndex struct {
+	mu    sync.RWMutex
+	feeds map[string]FeedStats // name -> stats
+}
+
+// NewFeedIndex returns an empty index
+func NewFeedIndex() *FeedIndex {
+	return &FeedIndex{feeds: make(map[string]FeedStats)}
+}
+
+// Index returns the index of generated feeds
+func (conf *Config) Index() *FeedIndex {
+	return conf.index
+}
+
+// Get returns the stats of the named feed and whether its file exists
+func (index *FeedIndex) Get(name string) (FeedStats, bool) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	stats, ok := index.feeds[name]
+	return stats, ok
+}
+
+// Build indexes all configured feeds
+func (index *FeedIndex) Build(conf *Config) {
+	for name := range conf.AllFeeds() {
+		index.Refresh(conf, name)
+	}
+}
+
+// Refresh updates the stats of the named feed from its file and state. The
+// feed file is only scanned again if it changed since it was last indexed.
+func (index *FeedIndex) Refresh(conf *Config, name string) {
+	fn := filepath.Join(conf.Root, fmt.Sprintf("%s.txt", name))
+
+	info, err := os.Stat(fn)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warnf("error getting feed stats for %s", name)
+		}
+		index.Remove(name)
+		return
+	}
+
+	stats, ok := index.Get(name)
+	if !ok || stats.Size != info.Size() || !stats.ModTime.Equal(info.ModTime()) {
+		twts, lastTwt, err := scanTwts(fn)
+		if err != nil {
+			log.WithError(err).Warnf("error reading feed %s", name)
+		}
+		stats = FeedStats{
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Twts:    twts,
+			LastTwt: lastTwt,
+		}
+	}
+
+	state, err := LoadState(conf, name)
+	if err != nil {
+		log.WithError(err).Warnf("error loading state for %s", name)
+	} else {
+		stats.Failures = state.Health.Failures
+	}
+
+	index.mu.Lock()
+	index.feeds[name] = stats
+	index.mu.Unlock()
+}
+
+// Remove removes the named feed from the index
+func (index *FeedIndex) Remove(name string) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	delete(index.feeds, name)
+}
+
+// scanTwts returns the number of twts in the feed file fn and the time of
+// the most recent one
+func scanTwts(fn string) (int, time.Time, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer f.Close()
+
+	var (
+		twts   int
+		latest time.Time
+	)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		twts++
+
+		parts := strings.SplitN(line, "\t", 2)
+		if created, err := time.Parse(time.RFC3339, parts[0]); err == nil && created.After(latest) {
+			latest = created
+		}
+	}
+
+	return twts, latest, scanner.Err()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFeedIndex(t *testing.T) {
+	conf, _ := newFeedConfig(t, "test", "https://example.com/feed.xml")
+	if err := conf.AddFeed("missing", FeedConfig{URL: "https://example.com/missing.xml"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fn := filepath.Join(conf.Root, "test.txt")
+	writeFeed := func(data string, modTime time.Time) {
+		t.Helper()
+		if err := ioutil.WriteFile(fn, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	third := time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	writeFeed("# nick = test\n\n"+
+		second.Format(time.RFC3339)+"\tTwo\n"+
+		first.Format(time.RFC3339)+"\tOne\n", first)
+
+	state, err := LoadState(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Health.Record(errors.New("failed"), first)
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	index := NewFeedIndex()
+	index.Build(conf)
+
+	stats, ok := index.Get("test")
+	if !ok {
+		t.Fatal("feed not indexed")
+	}
+	if stats.Twts != 2 || !stats.LastTwt.Equal(second) || stats.Failures != 1 {
+		t.Errorf("got %d twts, last at %s and %d failures, want 2, %s and 1", stats.Twts, stats.LastTwt, stats.Failures, second)
+	}
+	if _, ok := index.Get("missing"); ok {
+		t.Error("feed without a file indexed")
+	}
+	if _, ok := index.Get("unknown"); ok {
+		t.Error("unconfigured feed indexed")
+	}
+
+	// Refreshing rescans the feed once it changes
+	writeFeed(third.Format(time.RFC3339)+"\tThree\n"+
+		second.Format(time.RFC3339)+"\tTwo\n"+
+		first.Format(time.RFC3339)+"\tOne\n", third)
+	index.Refresh(conf, "test")
+
+	stats, _ = index.Get("test")
+	if stats.Twts != 3 || !stats.LastTwt.Equal(third) || !stats.ModTime.Equal(third) {
+		t.Errorf("got %d twts, last at %s, modified %s, want 3, %s and %s", stats.Twts, stats.LastTwt, stats.ModTime, third, third)
+	}
+
+	// Refreshing a removed feed removes it from the index
+	if err := os.Remove(fn); err != nil {
+		t.Fatal(err)
+	}
+	index.Refresh(conf, "test")
+	if _, ok := index.Get("test"); ok {
+		t.Error("removed feed still indexed")
+	}
+}
+
+func TestGetFeeds(t *testing.T) {
+	conf, _ := newFeedConfig(t, "b", "https://example.com/b.xml")
+	for _, name := range []string{"a", "new"} {
+		if err := conf.AddFeed(name, FeedConfig{URL: "https://example.com/" + name + ".xml"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	feeds := map[string]string{
+		"a": "2020-01-01T00:00:00Z\tOne\n",
+		"b": "# nick = b\n2020-01-02T00:00:00Z\tTwo\n2020-01-01T00:00:00Z\tOne\n",
+	}
+	for name, data := range feeds {
+		if err := ioutil.WriteFile(filepath.Join(conf.Root, name+".txt"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf.Index().Build(conf)
+
+	app := &App{conf: conf}
+	got := app.GetFeeds()
+
+	want := []struct {
+		name string
+		twts int
+	}{{"a", 1}, {"b", 2}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d feeds, want %d", len(got), len(want))
+	}
+	for i, feed := range got {
+		if feed.Name != want[i].name || feed.Twts != want[i].twts {
+			t.Errorf("got feed %s with %d twts, want %s with %d", feed.Name, feed.Twts, want[i].name, want[i].twts)
+		}
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/divan/num2words"
@@ -29,13 +32,15 @@ var (
 
 func init() {
 	Jobs = map[string]JobSpec{
-		"RotateFeeds": NewJobSpec("@daily", NewRotateFeedsJob),
-		"UpdateFeeds": NewJobSpec("@every 5m", NewUpdateFeedsJob),
-		"TikTokBot":   NewJobSpec("0 0,30 * * * *", NewTikTokJob),
+		"RotateFeeds":   NewJobSpec("@daily", NewRotateFeedsJob),
+		"PruneArchives": NewJobSpec("@hourly", NewPruneArchivesJob),
+		"UpdateFeeds":   NewJobSpec("@every 1m", NewUpdateFeedsJob),
+		"TikTokBot":     NewJobSpec("0 0,30 * * * *", NewTikTokJob),
 	}
 
 	StartupJobs = map[string]JobSpec{
-		"RotateFeeds": Jobs["RotateFeeds"],
+		"RotateFeeds":   Jobs["RotateFeeds"],
+		"PruneArchives": Jobs["PruneArchives"],
 	}
 }
 
@@ -52,49 +57,264 @@ func NewRotateFeedsJob(conf *Config) cron.Job {
 func (job *RotateFeedsJob) Run() {
 	conf := job.conf
 
-	files, err := WalkMatch(conf.Root, "*.txt")
-	if err != nil {
-		log.WithError(err).Error("error reading feeds directory")
-		return
-	}
+	for name := range conf.AllFeeds() {
+		if conf.ShuttingDown() {
+			return
+		}
 
-	for _, file := range files {
-		stat, err := os.Stat(file)
+		stat, err := os.Stat(feedFile(conf, name, "txt"))
 		if err != nil {
-			log.WithError(err).Error("error getting feed size")
+			if !os.IsNotExist(err) {
+				log.WithError(err).Errorf("error getting size of feed %s", name)
+			}
 			continue
 		}
 
 		if stat.Size() > conf.MaxSize {
 			log.Infof(
 				"rotating %s with size %s > %s",
-				BaseWithoutExt(file),
+				name,
 				humanize.Bytes(uint64(stat.Size())),
 				humanize.Bytes(uint64(conf.MaxSize)),
 			)
 
-			if err := RotateFile(file); err != nil {
+			if err := RotateFeed(conf, name, time.Now()); err != nil {
 				log.WithError(err).Error("error rotating feed")
 			}
 		}
 	}
 }
 
-type UpdateFeedsJob struct {
+// PruneArchivesJob enforces the retention policy on archived segments
+type PruneArchivesJob struct {
 	conf *Config
 }
 
+func NewPruneArchivesJob(conf *Config) cron.Job {
+	return &PruneArchivesJob{conf: conf}
+}
+
+func (job *PruneArchivesJob) Run() {
+	conf := job.conf
+
+	archives, err := Archives(conf.Root)
+	if err != nil {
+		log.WithError(err).Error("error reading feeds directory")
+		return
+	}
+
+	now := time.Now()
+	for name := range archives {
+		if conf.ShuttingDown() {
+			return
+		}
+		if err := PruneArchives(conf, name, now); err != nil {
+			log.WithError(err).Errorf("error pruning archives of %s", name)
+		}
+	}
+}
+
+// UpdateFeedsJob polls every feed that is due according to its schedule
+type UpdateFeedsJob struct {
+	conf    *Config
+	running int32 // set while a run is in progress
+
+	mu       sync.Mutex
+	schedule map[string]scheduledPoll // name -> next poll
+}
+
+// scheduledPoll is the next poll of a feed with the config it was
+// scheduled for
+type scheduledPoll struct {
+	next    time.Time
+	feed    FeedConfig
+	reloads int // config reloads when the schedule was loaded
+}
+
 func NewUpdateFeedsJob(conf *Config) cron.Job {
-	return &UpdateFeedsJob{conf: conf}
+	return &UpdateFeedsJob{
+		conf:     conf,
+		schedule: make(map[string]scheduledPoll),
+	}
+}
+
+// nextPoll returns when the named feed is next due to be polled, loading
+// the schedule from the feed's state the first time it is seen.
+func (job *UpdateFeedsJob) nextPoll(name string, feed FeedConfig) time.Time {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	if scheduled, ok := job.schedule[name]; ok {
+		return scheduled.next
+	}
+
+	// Read before the state so that a reload rescheduling the feed in the
+	// meantime discards the schedule on the next run
+	reloads := job.conf.Reloads()
+
+	state, err := LoadState(job.conf, name)
+	if err != nil {
+		log.WithError(err).Warnf("error loading state for %s", name)
+		return time.Time{}
+	}
+
+	job.schedule[name] = scheduledPoll{state.NextPoll, feed, reloads}
+	return state.NextPoll
+}
+
+// afterPoll reloads the schedule of the named feed after it was polled and
+// disables the feed if it has been failing for longer than DisableAfter.
+func (job *UpdateFeedsJob) afterPoll(name string, feed FeedConfig) {
+	conf := job.conf
+	now := time.Now()
+	poll := conf.Polling()
+	reloads := conf.Reloads()
+
+	state, err := LoadState(conf, name)
+	if err != nil {
+		log.WithError(err).Warnf("error loading state for %s", name)
+		job.mu.Lock()
+		job.schedule[name] = scheduledPoll{now.Add(poll.PollInterval(feed, 0)), feed, reloads}
+		job.mu.Unlock()
+		return
+	}
+
+	job.mu.Lock()
+	job.schedule[name] = scheduledPoll{state.NextPoll, feed, reloads}
+	job.mu.Unlock()
+
+	if state.Health.Failures > 0 && state.Health.LastStatus == http.StatusGone {
+		job.disableFeed(name, "feed is gone (410)")
+		return
+	}
+
+	if poll.DisableAfter > 0 && state.Health.Failing(poll.DisableAfter, now) {
+		job.disableFeed(name, fmt.Sprintf(
+			"failing since %s: %s",
+			humanize.Time(state.Health.FailingSince), state.Health.LastError,
+		))
+		return
+	}
+
+	if poll.RedirectThreshold > 0 && state.Redirects >= poll.RedirectThreshold && state.RedirectURL != feed.URL {
+		job.moveFeed(name, feed.URL, state.RedirectURL, state.Redirects)
+	}
+}
+
+func (job *UpdateFeedsJob) disableFeed(name, reason string) {
+	_, err := job.conf.ModifyFeed(name, func(feed *FeedConfig) error {
+		feed.Disabled = true
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Errorf("error disabling feed %s", name)
+		return
+	}
+
+	if err := job.conf.Save(); err != nil {
+		log.WithError(err).Error("error saving config")
+		return
+	}
+
+	log.Warnf("disabled feed %s: %s", name, reason)
+}
+
+// moveFeed updates the url of a feed that has been consistently redirected
+// permanently to a new url
+func (job *UpdateFeedsJob) moveFeed(name, from, to string, redirects int) {
+	_, err := job.conf.ModifyFeed(name, func(feed *FeedConfig) error {
+		// The url may have been changed concurrently
+		if feed.URL != from {
+			return fmt.Errorf("error: feed url changed from %s to %s", from, feed.URL)
+		}
+		feed.URL = to
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Errorf("error updating url of feed %s", name)
+		return
+	}
+
+	if err := job.conf.Save(); err != nil {
+		log.WithError(err).Error("error saving config")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"name":      name,
+		"from":      from,
+		"to":        to,
+		"redirects": redirects,
+	}).Warn("updated url of permanently redirected feed")
 }
 
 func (job *UpdateFeedsJob) Run() {
+	if !atomic.CompareAndSwapInt32(&job.running, 0, 1) {
+		log.Warn("previous feed update still running, skipping")
+		return
+	}
+	defer atomic.StoreInt32(&job.running, 0)
+
 	conf := job.conf
-	for name, url := range conf.Feeds {
-		if err := UpdateFeed(conf, name, url); err != nil {
-			log.WithError(err).Errorf("error updating feed %s: %s", name, url)
+
+	type work struct {
+		name string
+		feed FeedConfig
+	}
+
+	queue := make(chan work)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < conf.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range queue {
+				err := UpdateFeed(conf, w.name, w.feed)
+				if err == ErrFeedNotFound {
+					// Deleted or renamed since it was queued
+					continue
+				}
+				if err != nil {
+					log.WithError(err).Errorf("error updating feed %s: %s", w.name, w.feed.URL)
+				}
+				job.afterPoll(w.name, w.feed)
+			}
+		}()
+	}
+
+	now := time.Now()
+	feeds := conf.AllFeeds()
+	reloads := conf.Reloads()
+
+	job.mu.Lock()
+	for name, scheduled := range job.schedule {
+		// Forget disabled feeds so they are rescheduled from their state
+		// (which is reset) when re-enabled, and feeds whose config or the
+		// polling settings changed (e.g. on reload) so a new interval takes
+		// effect
+		if feed, ok := feeds[name]; !ok || feed.Disabled || feed != scheduled.feed || scheduled.reloads != reloads {
+			delete(job.schedule, name)
 		}
 	}
+	job.mu.Unlock()
+
+queue:
+	for name, feed := range feeds {
+		if feed.Disabled || now.Before(job.nextPoll(name, feed)) {
+			continue
+		}
+
+		// Workers finish the feeds they are updating when shutting down
+		select {
+		case queue <- work{name, feed}:
+		case <-conf.done:
+			break queue
+		}
+	}
+	close(queue)
+
+	wg.Wait()
 }
 
 type TikTokJob struct {
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	oldFeedURL = "https://example.com/old.xml"
+	newFeedURL = "https://example.com/new.xml"
+)
+
+// afterPollTest is a feed's state after a poll and the expected outcome
+type afterPollTest struct {
+	name         string
+	disableAfter time.Duration
+	health       Health
+	redirectURL  string
+	redirects    int
+	disabled     bool
+	url          string
+}
+
+// runAfterPoll polls a feed with the state of the test and checks whether
+// the feed was disabled or moved
+func runAfterPoll(t *testing.T, test afterPollTest) {
+	conf := NewConfig()
+	conf.Root = tempDir(t)
+	conf.path = filepath.Join(conf.Root, "config.yaml")
+	conf.DisableAfter = test.disableAfter
+	conf.RedirectThreshold = 3
+
+	feed := FeedConfig{URL: oldFeedURL}
+	if err := conf.AddFeed("test", feed); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := LoadState(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Health = test.health
+	state.RedirectURL = test.redirectURL
+	state.Redirects = test.redirects
+	state.NextPoll = time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	job := NewUpdateFeedsJob(conf).(*UpdateFeedsJob)
+	job.afterPoll("test", feed)
+
+	if next := job.nextPoll("test", feed); !next.Equal(state.NextPoll) {
+		t.Errorf("next poll %s, want %s", next, state.NextPoll)
+	}
+
+	updated, _ := conf.GetFeed("test")
+	if updated.Disabled != test.disabled {
+		t.Errorf("disabled = %t, want %t", updated.Disabled, test.disabled)
+	}
+	if updated.URL != test.url {
+		t.Errorf("url = %s, want %s", updated.URL, test.url)
+	}
+}
+
+func TestAfterPollDisable(t *testing.T) {
+	now := time.Now()
+
+	tests := []afterPollTest{
+		{name: "healthy", disableAfter: 24 * time.Hour, health: Health{LastSuccess: now}, url: oldFeedURL},
+		{
+			name:         "failing briefly",
+			disableAfter: 24 * time.Hour,
+			health:       Health{Failures: 3, FailingSince: now.Add(-time.Hour)},
+			url:          oldFeedURL,
+		},
+		{
+			name:         "failing too long",
+			disableAfter: 24 * time.Hour,
+			health:       Health{Failures: 30, FailingSince: now.Add(-25 * time.Hour)},
+			disabled:     true,
+			url:          oldFeedURL,
+		},
+		{
+			name:   "never disabled",
+			health: Health{Failures: 300, FailingSince: now.Add(-30 * 24 * time.Hour)},
+			url:    oldFeedURL,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) { runAfterPoll(t, test) })
+	}
+}
+
+func TestAfterPollRedirectsAndGone(t *testing.T) {
+	now := time.Now()
+
+	tests := []afterPollTest{
+		{
+			name:         "gone",
+			disableAfter: 24 * time.Hour,
+			health:       Health{Failures: 1, FailingSince: now, LastStatus: http.StatusGone},
+			disabled:     true,
+			url:          oldFeedURL,
+		},
+		{
+			name:     "gone without disableafter",
+			health:   Health{Failures: 1, FailingSince: now, LastStatus: http.StatusGone},
+			disabled: true,
+			url:      oldFeedURL,
+		},
+		{
+			name:         "back from gone",
+			disableAfter: 24 * time.Hour,
+			health:       Health{LastSuccess: now, LastStatus: http.StatusGone},
+			url:          oldFeedURL,
+		},
+		{
+			name:        "redirected below threshold",
+			health:      Health{LastSuccess: now},
+			redirectURL: newFeedURL,
+			redirects:   2,
+			url:         oldFeedURL,
+		},
+		{
+			name:        "redirected",
+			health:      Health{LastSuccess: now},
+			redirectURL: newFeedURL,
+			redirects:   3,
+			url:         newFeedURL,
+		},
+		{
+			name:        "redirected to itself",
+			health:      Health{LastSuccess: now},
+			redirectURL: oldFeedURL,
+			redirects:   3,
+			url:         oldFeedURL,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) { runAfterPoll(t, test) })
+	}
+}
+
+func TestFetchFeedRedirectsAndGone(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/moved.xml", http.RedirectHandler("/feed.xml", http.StatusMovedPermanently))
+	mux.Handle("/found.xml", http.RedirectHandler("/feed.xml", http.StatusFound))
+	mux.Handle("/chain.xml", http.RedirectHandler("/found.xml", http.StatusPermanentRedirect))
+	mux.HandleFunc("/gone.xml", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	})
+	mux.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprintf(w, testRSS, "redirected")
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		path        string
+		status      int
+		failed      bool
+		redirectURL string
+	}{
+		{"/feed.xml", http.StatusOK, false, ""},
+		{"/moved.xml", http.StatusOK, false, server.URL + "/feed.xml"},
+		{"/found.xml", http.StatusOK, false, ""},
+		{"/chain.xml", http.StatusOK, false, ""},
+		{"/gone.xml", http.StatusGone, true, ""},
+	}
+
+	for _, test := range tests {
+		conf, feed := newFeedConfig(t, "test", server.URL+test.path)
+
+		// Polling twice counts consecutive redirects
+		for i := 0; i < 2; i++ {
+			err := UpdateFeed(conf, "test", feed)
+			if failed := err != nil; failed != test.failed {
+				t.Fatalf("%s: unexpected error %v", test.path, err)
+			}
+		}
+
+		state, err := LoadState(conf, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Health.LastStatus != test.status {
+			t.Errorf("%s: status = %d, want %d", test.path, state.Health.LastStatus, test.status)
+		}
+		if test.failed && state.Health.Failures != 2 {
+			t.Errorf("%s: failures = %d, want 2", test.path, state.Health.Failures)
+		}
+		if state.RedirectURL != test.redirectURL {
+			t.Errorf("%s: redirected to %q, want %q", test.path, state.RedirectURL, test.redirectURL)
+		}
+		if test.redirectURL != "" && state.Redirects != 2 {
+			t.Errorf("%s: redirects = %d, want 2", test.path, state.Redirects)
+		}
+	}
+}
+
+func TestRotateFeedsJob(t *testing.T) {
+	conf := NewConfig()
+	conf.Root = tempDir(t)
+	conf.MaxSize = 10
+	conf.KeepTwts = 1
+
+	if err := conf.AddFeed("test", FeedConfig{URL: oldFeedURL}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(conf.Root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	twts := []byte("2024-01-01T00:00:00Z\tone\n2024-01-01T00:00:01Z\ttwo\n")
+	for _, name := range []string{"test.txt", "tiktok.txt", "sub/test.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(conf.Root, name), twts, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	NewRotateFeedsJob(conf).Run()
+
+	archives, err := Archives(conf.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 1 || len(archives["test"]) != 1 {
+		t.Errorf("archives = %+v, want one of test", archives)
+	}
+	for _, name := range []string{"tiktok.txt", "sub/test.txt"} {
+		if data := readHistory(t, filepath.Join(conf.Root, name)); data != string(twts) {
+			t.Errorf("%s was rotated:\n%s", name, data)
+		}
+	}
+}
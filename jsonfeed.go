@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+const (
+	jsonFeedVersionPrefix = "https://jsonfeed.org/version/"
+)
+
+var (
+	ErrInvalidJSONFeed = errors.New("error: invalid JSON feed")
+)
+
+// jsonFeed is a JSON Feed 1.0 or 1.1 document, see https://jsonfeed.org/
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Description string           `json:"description"`
+	Icon        string           `json:"icon"`
+	Favicon     string           `json:"favicon"`
+	Author      *jsonFeedAuthor  `json:"author"`  // 1.0
+	Authors     []jsonFeedAuthor `json:"authors"` // 1.1
+	Language    string           `json:"language"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Avatar string `json:"avatar"`
+}
+
+type jsonFeedAttachment struct {
+	URL         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	Title       string `json:"title"`
+	SizeInBytes int64  `json:"size_in_bytes"`
+}
+
+type jsonFeedItem struct {
+	ID            jsonFeedID           `json:"id"`
+	URL           string               `json:"url"`
+	ExternalURL   string               `json:"external_url"`
+	Title         string               `json:"title"`
+	ContentHTML   string               `json:"content_html"`
+	ContentText   string               `json:"content_text"`
+	Summary       string               `json:"summary"`
+	Image         string               `json:"image"`
+	BannerImage   string               `json:"banner_image"`
+	DatePublished string               `json:"date_published"`
+	DateModified  string               `json:"date_modified"`
+	Author        *jsonFeedAuthor      `json:"author"`  // 1.0
+	Authors       []jsonFeedAuthor     `json:"authors"` // 1.1
+	Tags          []string             `json:"tags"`
+	Attachments   []jsonFeedAttachment `json:"attachments"`
+}
+
+// jsonFeedID is an item id, which some feeds publish as a number rather
+// than the string required by the spec
+type jsonFeedID string
+
+func (id *jsonFeedID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*id = jsonFeedID(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*id = jsonFeedID(n.String())
+	return nil
+}
+
+// IsJSONFeed reports whether data looks like a JSON document rather than
+// an XML feed
+func IsJSONFeed(data []byte) bool {
+	data = trimJSON(data)
+	return len(data) > 0 && data[0] == '{'
+}
+
+// trimJSON strips a leading byte order mark and whitespace from data
+func trimJSON(data []byte) []byte {
+	return bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), " \t\r\n")
+}
+
+// ParseJSONFeed parses a JSON Feed and translates it into a universal feed.
+// The feed icon becomes the feed image (used as avatar), authors become the
+// feed and item authors, attachments become enclosures and the item image
+// or banner image becomes the item image.
+func ParseJSONFeed(data []byte) (*gofeed.Feed, error) {
+	var doc jsonFeed
+	if err := json.Unmarshal(trimJSON(data), &doc); err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(doc.Version, jsonFeedVersionPrefix) {
+		return nil, ErrInvalidJSONFeed
+	}
+
+	feed := &gofeed.Feed{
+		Title:       doc.Title,
+		Description: doc.Description,
+		Link:        doc.HomePageURL,
+		FeedLink:    doc.FeedURL,
+		Author:      jsonFeedPerson(doc.Author, doc.Authors),
+		Language:    doc.Language,
+		FeedType:    "json",
+		FeedVersion: strings.TrimPrefix(doc.Version, jsonFeedVersionPrefix),
+		Items:       []*gofeed.Item{},
+	}
+
+	if doc.Icon != "" {
+		feed.Image = &gofeed.Image{URL: doc.Icon, Title: doc.Title}
+	} else if doc.Favicon != "" {
+		feed.Image = &gofeed.Image{URL: doc.Favicon, Title: doc.Title}
+	}
+
+	for _, it := range doc.Items {
+		item := &gofeed.Item{
+			GUID:        string(it.ID),
+			Title:       it.Title,
+			Description: it.Summary,
+			Content:     it.ContentHTML,
+			Link:        it.URL,
+			Published:   it.DatePublished,
+			Updated:     it.DateModified,
+			Author:      jsonFeedPerson(it.Author, it.Authors),
+			Categories:  it.Tags,
+		}
+
+		if item.Content == "" {
+			item.Content = it.ContentText
+		}
+		if item.Link == "" {
+			item.Link = it.ExternalURL
+		}
+		if item.Author == nil {
+			// Items inherit the authors of the feed
+			item.Author = feed.Author
+		}
+
+		if t, err := time.Parse(time.RFC3339, it.DatePublished); err == nil {
+			item.PublishedParsed = &t
+		}
+		if t, err := time.Parse(time.RFC3339, it.DateModified); err == nil {
+			item.UpdatedParsed = &t
+		}
+
+		if it.Image != "" {
+			item.Image = &gofeed.Image{URL: it.Image}
+		} else if it.BannerImage != "" {
+			item.Image = &gofeed.Image{URL: it.BannerImage}
+		}
+
+		custom := make(map[string]string)
+		if it.ExternalURL != "" {
+			custom["external_url"] = it.ExternalURL
+		}
+		if it.BannerImage != "" {
+			custom["banner_image"] = it.BannerImage
+		}
+		if len(custom) > 0 {
+			item.Custom = custom
+		}
+
+		for _, attachment := range it.Attachments {
+			enclosure := &gofeed.Enclosure{
+				URL:  attachment.URL,
+				Type: attachment.MimeType,
+			}
+			if attachment.SizeInBytes > 0 {
+				enclosure.Length = strconv.FormatInt(attachment.SizeInBytes, 10)
+			}
+			item.Enclosures = append(item.Enclosures, enclosure)
+		}
+
+		feed.Items = append(feed.Items, item)
+	}
+
+	return feed, nil
+}
+
+// jsonFeedPerson returns the first of the JSON Feed 1.1 authors or the 1.0
+// author, or nil if there are none
+func jsonFeedPerson(author *jsonFeedAuthor, authors []jsonFeedAuthor) *gofeed.Person {
+	if len(authors) > 0 {
+		author = &authors[0]
+	}
+	if author == nil {
+		return nil
+	}
+
+	name := author.Name
+	if name == "" {
+		name = author.URL
+	}
+	if name == "" {
+		return nil
+	}
+	return &gofeed.Person{Name: name}
+}
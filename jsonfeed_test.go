@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const testJSONFeed11 = "\xef\xbb\xbf" + `
+{
+  "version": "https://jsonfeed.org/version/1.1",
+  "title": "Example",
+  "home_page_url": "https://example.com/",
+  "feed_url": "https://example.com/feed.json",
+  "favicon": "https://example.com/favicon.ico",
+  "authors": [{"name": "Ann"}, {"name": "Bob"}],
+  "items": [
+    {
+      "id": "1",
+      "url": "https://example.com/1",
+      "title": "One",
+      "content_html": "<p>One</p>",
+      "content_text": "One",
+      "date_published": "2024-01-02T03:04:05+01:00",
+      "date_modified": "2024-01-03T00:00:00Z",
+      "banner_image": "https://example.com/banner.png",
+      "tags": ["a", "b"],
+      "attachments": [
+        {"url": "https://example.com/1.mp3", "mime_type": "audio/mpeg", "size_in_bytes": 1234},
+        {"url": "https://example.com/1.ogg", "mime_type": "audio/ogg"}
+      ]
+    },
+    {
+      "id": 2,
+      "external_url": "https://elsewhere.example.com/2",
+      "content_text": "Two",
+      "image": "https://example.com/2.png",
+      "banner_image": "https://example.com/banner.png",
+      "authors": [{"url": "https://example.com/~carol"}]
+    }
+  ]
+}`
+
+const testJSONFeed10 = `{
+  "version": "https://jsonfeed.org/version/1",
+  "title": "Example",
+  "icon": "https://example.com/icon.png",
+  "favicon": "https://example.com/favicon.ico",
+  "author": {"name": "Ann"},
+  "items": [{"id": "1", "url": "https://example.com/1", "content_text": "One"}]
+}`
+
+func TestParseJSONFeed(t *testing.T) {
+	if !IsJSONFeed([]byte(testJSONFeed11)) {
+		t.Fatal("IsJSONFeed() = false, want true")
+	}
+
+	feed, err := ParseJSONFeed([]byte(testJSONFeed11))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if feed.Title != "Example" || feed.Link != "https://example.com/" || feed.FeedLink != "https://example.com/feed.json" {
+		t.Errorf("unexpected feed %+v", feed)
+	}
+	if feed.FeedType != "json" || feed.FeedVersion != "1.1" {
+		t.Errorf("feed type = %s %s, want json 1.1", feed.FeedType, feed.FeedVersion)
+	}
+	if feed.Image == nil || feed.Image.URL != "https://example.com/favicon.ico" {
+		t.Errorf("feed image = %+v, want the favicon", feed.Image)
+	}
+	if feed.Author == nil || feed.Author.Name != "Ann" {
+		t.Errorf("feed author = %+v, want the first author", feed.Author)
+	}
+	if len(feed.Items) != 2 {
+		t.Fatalf("parsed %d items, want 2", len(feed.Items))
+	}
+
+	one := feed.Items[0]
+	if one.GUID != "1" || one.Link != "https://example.com/1" || one.Title != "One" {
+		t.Errorf("unexpected item %+v", one)
+	}
+	if one.Content != "<p>One</p>" {
+		t.Errorf("content = %q, want the html content", one.Content)
+	}
+	if one.Author == nil || one.Author.Name != "Ann" {
+		t.Errorf("item author = %+v, want the feed's author", one.Author)
+	}
+	published := time.Date(2024, 1, 2, 2, 4, 5, 0, time.UTC)
+	if one.PublishedParsed == nil || !one.PublishedParsed.Equal(published) {
+		t.Errorf("published = %v, want %s", one.PublishedParsed, published)
+	}
+	if one.UpdatedParsed == nil || one.UpdatedParsed.Unix() != 1704240000 {
+		t.Errorf("updated = %v, want 2024-01-03", one.UpdatedParsed)
+	}
+	if one.Image == nil || one.Image.URL != "https://example.com/banner.png" {
+		t.Errorf("item image = %+v, want the banner image", one.Image)
+	}
+	if len(one.Categories) != 2 {
+		t.Errorf("categories = %v, want the tags", one.Categories)
+	}
+	if len(one.Enclosures) != 2 {
+		t.Fatalf("parsed %d enclosures, want 2", len(one.Enclosures))
+	}
+	if e := one.Enclosures[0]; e.URL != "https://example.com/1.mp3" || e.Type != "audio/mpeg" || e.Length != "1234" {
+		t.Errorf("unexpected enclosure %+v", e)
+	}
+	if e := one.Enclosures[1]; e.Length != "" {
+		t.Errorf("enclosure length = %q, want none", e.Length)
+	}
+
+	two := feed.Items[1]
+	if two.GUID != "2" {
+		t.Errorf("guid = %q, want the numeric id", two.GUID)
+	}
+	if two.Link != "https://elsewhere.example.com/2" || two.Custom["external_url"] != two.Link {
+		t.Errorf("link = %q, want the external url", two.Link)
+	}
+	if two.Content != "Two" {
+		t.Errorf("content = %q, want the text content", two.Content)
+	}
+	if two.Image == nil || two.Image.URL != "https://example.com/2.png" {
+		t.Errorf("item image = %+v, want the image", two.Image)
+	}
+	if two.Author == nil || two.Author.Name != "https://example.com/~carol" {
+		t.Errorf("item author = %+v, want the author's url", two.Author)
+	}
+	if two.PublishedParsed != nil {
+		t.Errorf("published = %v, want none", two.PublishedParsed)
+	}
+}
+
+func TestParseJSONFeed10(t *testing.T) {
+	feed, err := ParseJSONFeed([]byte(testJSONFeed10))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if feed.FeedVersion != "1" {
+		t.Errorf("version = %s, want 1", feed.FeedVersion)
+	}
+	if feed.Image == nil || feed.Image.URL != "https://example.com/icon.png" {
+		t.Errorf("feed image = %+v, want the icon", feed.Image)
+	}
+	if feed.Author == nil || feed.Author.Name != "Ann" {
+		t.Errorf("feed author = %+v, want Ann", feed.Author)
+	}
+	if len(feed.Items) != 1 || feed.Items[0].Author == nil || feed.Items[0].Author.Name != "Ann" {
+		t.Errorf("items did not inherit the feed author")
+	}
+}
+
+func TestParseJSONFeedInvalid(t *testing.T) {
+	tests := []string{
+		`{"title": "no version", "items": []}`,
+		`{"version": "https://example.com/version/1", "items": []}`,
+	}
+	for _, data := range tests {
+		if _, err := ParseJSONFeed([]byte(data)); err != ErrInvalidJSONFeed {
+			t.Errorf("ParseJSONFeed(%s) = %v, want ErrInvalidJSONFeed", data, err)
+		}
+	}
+
+	if _, err := ParseJSONFeed([]byte(`{"version": `)); err == nil {
+		t.Error("expected error for malformed json")
+	}
+	if IsJSONFeed([]byte(`<?xml version="1.0"?><rss></rss>`)) {
+		t.Error("IsJSONFeed() = true for an xml feed")
+	}
+}
@@ -0,0 +1,98 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// flock applies or removes an advisory lock on f, retrying if interrupted
+func flock(f *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// lockFile takes an exclusive lock on the named file shared with other
+// processes, creating the file if needed and waiting for other processes
+// to release it, and returns the function that releases it
+func lockFile(fn string) (func(), error) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flock(f, syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Closing the file releases the lock
+	return func() { f.Close() }, nil
+}
+
+// lockServer takes the lock held by a running server on the pid file fn
+// and writes the server's pid to it, failing with ErrServerRunning if
+// another server holds it
+func lockServer(fn string) (func(), error) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flock(f, syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrServerRunning
+		}
+		return nil, err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteString(fmt.Sprintf("%d\n", os.Getpid())); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		os.Remove(fn)
+		f.Close()
+	}, nil
+}
+
+// serverPID returns the pid of the server holding the lock on the pid file
+// fn, if any
+func serverPID(fn string) (int, bool) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	if err := flock(f, syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		// Left behind by a server that is no longer running
+		return 0, false
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false
+	}
+	return pid, true
+}
@@ -0,0 +1,61 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockServer(t *testing.T) {
+	fn := filepath.Join(tempDir(t), "config.yaml.pid")
+
+	if _, ok := serverPID(fn); ok {
+		t.Fatal("found a server before one started")
+	}
+
+	unlock, err := lockServer(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid, ok := serverPID(fn); !ok || pid != os.Getpid() {
+		t.Errorf("serverPID = %d, %t, want %d", pid, ok, os.Getpid())
+	}
+	if _, err := lockServer(fn); err != ErrServerRunning {
+		t.Errorf("expected ErrServerRunning, got %v", err)
+	}
+
+	unlock()
+	if _, ok := serverPID(fn); ok {
+		t.Error("found a server after it stopped")
+	}
+}
+
+func TestLockFeedAcrossConfigs(t *testing.T) {
+	fn := writeConfig(t, "root: "+tempDir(t)+"\nfeeds:\n  a: https://example.com/a.xml\n")
+	first, second := mustLoadConfig(t, fn), mustLoadConfig(t, fn)
+
+	unlock := first.LockFeed("a")
+
+	locked := make(chan struct{})
+	go func() {
+		second.LockFeed("a")()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("feed was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("feed was not unlocked")
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+// File locks are not supported on Windows, where feeds and the config are
+// only locked within a process and the cli can't tell a running server to
+// reload the config.
+
+func lockFile(fn string) (func(), error) {
+	return func() {}, nil
+}
+
+func lockServer(fn string) (func(), error) {
+	return func() {}, nil
+}
+
+func serverPID(fn string) (int, bool) {
+	return 0, false
+}
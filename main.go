@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
@@ -19,16 +20,24 @@ var (
 
 func init() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "用法: %s [配置项]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "用法: %s [配置项] <命令> [参数]\n\n命令:\n", os.Args[0])
+		for _, cmd := range Commands {
+			fmt.Fprintf(os.Stderr, "  %-28s %s\n", strings.TrimSpace(cmd.Name+" "+cmd.Args), cmd.Short)
+		}
+		fmt.Fprintf(os.Stderr, "  %-28s %s\n", "<url> <name>", "添加（如尚未添加）并更新 Feed 源，同 add 后 update")
+		fmt.Fprintf(os.Stderr, "\n配置项:\n")
 		flag.PrintDefaults()
 	}
 
+	// Flags after the command are the command's own
+	flag.CommandLine.SetInterspersed(false)
+
 	flag.BoolVarP(&version, "version", "v", false, "显示版本信息")
 	flag.BoolVarP(&debug, "debug", "d", false, "启用调试")
 
-	flag.BoolVarP(&server, "server", "s", false, "Web 服务模式")
+	flag.BoolVarP(&server, "server", "s", false, "Web 服务模式（同 serve 命令）")
 	flag.StringVarP(&bind, "bind", "b", "0.0.0.0:8001", "Web 服务模式绑定地址及端口")
-	flag.StringVarP(&config, "config", "c", "config.yaml", "Web 服务模式下使用的配置文件")
+	flag.StringVarP(&config, "config", "c", "config.yaml", "使用的配置文件")
 }
 
 func main() {
@@ -45,21 +54,41 @@ func main() {
 		os.Exit(0)
 	}
 
+	args := flag.Args()
 	if server {
-		app, err := NewApp(bind, config)
-		if err != nil {
-			log.WithError(err).Fatal("error creating app for server mode")
-		}
-		if err := app.Run(); err != nil {
-			log.WithError(err).Fatal("error running app")
+		args = append([]string{"serve"}, args...)
+	}
+
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// rss2twt <url> <name> adds and updates a feed as earlier versions did
+	if len(args) == 2 && isHTTPURL(args[0]) {
+		if err := oneShot(args[0], args[1]); err != nil {
+			if err == ErrUsage {
+				os.Exit(2)
+			}
+			log.WithError(err).Fatal("error updating feed")
 		}
 		os.Exit(0)
 	}
 
-	url := flag.Arg(0)
-	name := flag.Arg(1)
+	cmd, ok := FindCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "未知命令: %s（添加 Feed 源请使用 add <url> [name]）\n\n", args[0])
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	if err := UpdateFeed(&Config{Root: "."}, name, url); err != nil {
-		log.WithError(err).Fatal("error updating feed")
+	if err := cmd.Run(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		if err == ErrUsage {
+			os.Exit(2)
+		}
+		log.WithError(err).Fatalf("error running %s", cmd.Name)
 	}
 }
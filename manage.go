@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	tombstoneTwt = "此 Feed 源已停止更新，感谢关注 👋"
+)
+
+var (
+	// ErrArchivesWithoutTombstone is returned when deleting a feed keeping
+	// its archives but not its feed file, which is the only link to them
+	// and keeps its name from being reused by another feed
+	ErrArchivesWithoutTombstone = errors.New("error: archives can only be kept with a tombstone")
+)
+
+// DeleteOptions controls what is left behind when a feed is deleted
+type DeleteOptions struct {
+	// KeepArchives keeps the archived segments of the feed reachable. It
+	// requires Tombstone.
+	KeepArchives bool
+
+	// Tombstone keeps the feed file, ending it with a final twt telling
+	// followers that the feed has ended, and reserves the feed's name
+	Tombstone bool
+}
+
+// feedFile returns the path of a file of the named feed with extension ext
+func feedFile(conf *Config, name, ext string) string {
+	return filepath.Join(conf.Root, fmt.Sprintf("%s.%s", name, ext))
+}
+
+// removeFile removes fn ignoring files that don't exist
+func removeFile(fn string) error {
+	if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DeleteFeed removes the named feed from the configuration, saving it
+// before removing the feed's files from disk so that other processes using
+// the config file stop updating them
+func DeleteFeed(conf *Config, name string, opts DeleteOptions, now time.Time) (FeedConfig, error) {
+	if opts.KeepArchives && !opts.Tombstone {
+		return FeedConfig{}, ErrArchivesWithoutTombstone
+	}
+
+	unlock := conf.LockFeed(name)
+	defer unlock()
+
+	var (
+		feed FeedConfig
+		err  error
+	)
+	if opts.Tombstone {
+		feed, err = conf.EndFeed(name, now)
+	} else {
+		feed, err = conf.RemoveFeed(name)
+	}
+	if err != nil {
+		return FeedConfig{}, err
+	}
+
+	if err := conf.Save(); err != nil {
+		return feed, err
+	}
+
+	// Processes waiting for the lock find the feed gone once they get it
+	files := []string{StateFile(conf, name), feedFile(conf, name, "lock")}
+	if !opts.Tombstone {
+		files = append(files, feedFile(conf, name, "txt"), feedFile(conf, name, "png"))
+	}
+
+	if !opts.KeepArchives {
+		archives, err := Archives(conf.Root)
+		if err != nil {
+			return feed, err
+		}
+		for _, archive := range archives[name] {
+			files = append(files, archive.Path)
+		}
+	}
+
+	for _, fn := range files {
+		if err := removeFile(fn); err != nil {
+			return feed, err
+		}
+	}
+
+	conf.Index().Remove(name)
+
+	if opts.Tombstone {
+		if err := writeTombstone(conf, name, !opts.KeepArchives, now); err != nil {
+			return feed, err
+		}
+	}
+
+	return feed, nil
+}
+
+// writeTombstone appends the final twt to an ended feed, removing the link
+// to its archives if they were deleted
+func writeTombstone(conf *Config, name string, unlinkArchives bool, now time.Time) error {
+	fn := feedFile(conf, name, "txt")
+
+	if unlinkArchives {
+		if err := unlinkFeed(fn); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return AppendTwt(f, tombstoneTwt, now)
+}
+
+// RenameFeed renames a feed moving its files and recording a redirect so
+// the old urls keep working. The caller is responsible for saving the
+// configuration.
+func RenameFeed(conf *Config, from, to string) (FeedConfig, error) {
+	if !validName.MatchString(to) {
+		return FeedConfig{}, ErrInvalidName
+	}
+	if from == to {
+		return FeedConfig{}, ErrFeedExists
+	}
+
+	// Lock both feeds in a consistent order to avoid deadlocks
+	names := []string{from, to}
+	sort.Strings(names)
+	for _, name := range names {
+		unlock := conf.LockFeed(name)
+		defer unlock()
+	}
+
+	archives, err := Archives(conf.Root)
+	if err != nil {
+		return FeedConfig{}, err
+	}
+
+	moves := make(map[string]string)
+	for _, ext := range []string{"txt", "state", "png"} {
+		moves[feedFile(conf, from, ext)] = feedFile(conf, to, ext)
+	}
+	for _, archive := range archives[from] {
+		moves[archive.Path] = filepath.Join(conf.Root, to+strings.TrimPrefix(filepath.Base(archive.Path), from))
+	}
+
+	// Leftover files of another feed also keep the name in use
+	for _, dst := range moves {
+		if Exists(dst) {
+			return FeedConfig{}, ErrFeedExists
+		}
+	}
+
+	feed, err := conf.RenameFeed(from, to)
+	if err != nil {
+		return FeedConfig{}, err
+	}
+
+	conf.Index().Remove(from)
+	defer conf.Index().Refresh(conf, to)
+
+	for src, dst := range moves {
+		if !Exists(src) {
+			continue
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return feed, err
+		}
+	}
+
+	// The lock file of the new name was created when locking it, so the old
+	// one is removed rather than moved over it
+	if err := removeFile(feedFile(conf, from, "lock")); err != nil {
+		return feed, err
+	}
+
+	// Fetch the whole feed on the next poll so that the metadata header is
+	// rewritten with the new name
+	state, err := LoadState(conf, to)
+	if err != nil {
+		return feed, err
+	}
+	state.ETag = ""
+	state.LastModified = ""
+	if err := state.Save(); err != nil {
+		return feed, err
+	}
+
+	log.Infof("renamed feed %s to %s", from, to)
+
+	return feed, nil
+}
+
+// PauseFeed stops polling the named feed until it is resumed
+func PauseFeed(conf *Config, name string) (FeedConfig, error) {
+	return conf.ModifyFeed(name, func(feed *FeedConfig) error {
+		feed.Disabled = true
+		return nil
+	})
+}
+
+// ResumeFeed resumes polling a paused or disabled feed resetting its health
+func ResumeFeed(conf *Config, name string) (FeedConfig, error) {
+	feed, err := conf.ModifyFeed(name, func(feed *FeedConfig) error {
+		feed.Disabled = false
+		return nil
+	})
+	if err != nil {
+		return FeedConfig{}, err
+	}
+
+	if err := ResetHealth(conf, name); err != nil {
+		log.WithError(err).Warnf("error resetting health of %s", name)
+	}
+
+	return feed, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteFeedKeepArchives(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	conf := NewConfig()
+	conf.Root = tempDir(t)
+	conf.path = filepath.Join(conf.Root, "config.yaml")
+	if err := conf.AddFeed("test", FeedConfig{URL: "https://example.com/feed.xml"}); err != nil {
+		t.Fatal(err)
+	}
+	writeHistory(t, conf, now, 2)
+
+	// Without the feed file nothing links to the kept archives and another
+	// feed could take over the name
+	_, err := DeleteFeed(conf, "test", DeleteOptions{KeepArchives: true}, now)
+	if err != ErrArchivesWithoutTombstone {
+		t.Fatalf("expected ErrArchivesWithoutTombstone, got %v", err)
+	}
+	if !conf.HasFeed("test") || !Exists(feedFile(conf, "test", "txt")) {
+		t.Fatal("feed was deleted")
+	}
+
+	if _, err := DeleteFeed(conf, "test", DeleteOptions{KeepArchives: true, Tombstone: true}, now); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !conf.IsEnded("test") {
+		t.Error("name of the feed was not reserved")
+	}
+	if Exists(feedFile(conf, "test", "lock")) {
+		t.Error("lock file of the deleted feed was left behind")
+	}
+	if kept := keptArchives(t, conf.Root, now); len(kept) != 2 {
+		t.Errorf("kept archives %v, want 2", kept)
+	}
+	data := readHistory(t, feedFile(conf, "test", "txt"))
+	if !strings.Contains(data, "# prev") || !strings.Contains(data, tombstoneTwt) {
+		t.Errorf("feed does not link to its archives or was not ended:\n%s", data)
+	}
+}
+
+func TestDeleteFeedTombstone(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	conf := NewConfig()
+	conf.Root = tempDir(t)
+	conf.path = filepath.Join(conf.Root, "config.yaml")
+	if err := conf.AddFeed("test", FeedConfig{URL: "https://example.com/feed.xml"}); err != nil {
+		t.Fatal(err)
+	}
+	writeHistory(t, conf, now, 2)
+
+	if _, err := DeleteFeed(conf, "test", DeleteOptions{Tombstone: true}, now); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if kept := keptArchives(t, conf.Root, now); len(kept) != 0 {
+		t.Errorf("kept archives %v, want none", kept)
+	}
+	data := readHistory(t, feedFile(conf, "test", "txt"))
+	if strings.Contains(data, "# prev") || !strings.Contains(data, tombstoneTwt) {
+		t.Errorf("feed links to deleted archives or was not ended:\n%s", data)
+	}
+}
+
+func TestRenameFeedLockFile(t *testing.T) {
+	conf := NewConfig()
+	conf.Root = tempDir(t)
+	conf.path = filepath.Join(conf.Root, "config.yaml")
+	if err := conf.AddFeed("old", FeedConfig{URL: "https://example.com/feed.xml"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RenameFeed(conf, "old", "new"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if Exists(feedFile(conf, "old", "lock")) {
+		t.Error("lock file of the old name was left behind")
+	}
+	if !Exists(feedFile(conf, "new", "lock")) {
+		t.Error("lock file of the new name was removed")
+	}
+}
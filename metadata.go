@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// metadataKeys are the header fields maintained from the source feed, in
+// the order they are written. Other comments in the header are preserved.
+var metadataKeys = []string{"nick", "url", "avatar", "description", "link"}
+
+// Metadata is the twtxt metadata written as comments at the top of a feed
+type Metadata map[string]string
+
+// FeedMetadata returns the metadata of the twtxt feed name generated from
+// the source feed
+func FeedMetadata(conf *Config, name string, feedConf FeedConfig, feed *gofeed.Feed) Metadata {
+	meta := Metadata{"nick": feedConf.DisplayNick(name)}
+
+	if conf.BaseURL != "" {
+		meta["url"] = URLForFeed(conf, name)
+		meta["avatar"] = URLForAvatar(conf, name)
+	}
+
+	description := plainText(feed.Description)
+	if description == "" {
+		description = plainText(feed.Title)
+	}
+	meta["description"] = description
+
+	if feed.Link != "" {
+		title := plainText(feed.Title)
+		if title == "" {
+			title = name
+		}
+		meta["link"] = fmt.Sprintf("%s %s", title, feed.Link)
+	}
+
+	return meta
+}
+
+// Header renders the metadata as twtxt comments followed by the other
+// comments in extra
+func (meta Metadata) Header(extra []string) []byte {
+	buf := &bytes.Buffer{}
+	for _, key := range metadataKeys {
+		if value := meta[key]; value != "" {
+			fmt.Fprintf(buf, "# %s = %s\n", key, value)
+		}
+	}
+	for _, line := range extra {
+		fmt.Fprintln(buf, line)
+	}
+	if buf.Len() > 0 {
+		buf.WriteString("#\n")
+	}
+	return buf.Bytes()
+}
+
+// readHeader returns the leading comment block of the feed file fn and the
+// comments in it that are not maintained metadata fields
+func readHeader(fn string) ([]byte, []string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var (
+		header []byte
+		extra  []string
+	)
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		header = append(header, line...)
+
+		comment := strings.TrimRight(line, "\r\n")
+		if comment != "#" && !isMetadataComment(comment) {
+			extra = append(extra, comment)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return header, extra, nil
+}
+
+func isMetadataComment(line string) bool {
+	parts := strings.SplitN(strings.TrimPrefix(line, "#"), "=", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	key := strings.TrimSpace(parts[0])
+	for _, k := range metadataKeys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteMetadata writes the metadata header of the feed file fn, creating
+// the file if needed. The file is only rewritten if the header changed.
+func WriteMetadata(fn string, meta Metadata) error {
+	current, extra, err := readHeader(fn)
+	if err != nil {
+		return err
+	}
+
+	header := meta.Header(extra)
+	if bytes.Equal(current, header) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	body := bytes.TrimPrefix(data, current)
+	return WriteFileAtomic(fn, append(header, body...), 0644)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestFeedMetadata(t *testing.T) {
+	conf := NewConfig()
+	conf.BaseURL = "https://feeds.example.com/"
+
+	feed := &gofeed.Feed{
+		Title:       "Example <b>News</b>",
+		Description: "All the <i>news</i> &amp; more",
+		Link:        "https://example.com/",
+	}
+
+	meta := FeedMetadata(conf, "news", FeedConfig{Nick: "News"}, feed)
+	want := Metadata{
+		"nick":        "News",
+		"url":         "https://feeds.example.com/news/twtxt.txt",
+		"avatar":      "https://feeds.example.com/news/avatar.png",
+		"description": "All the news & more",
+		"link":        "Example News https://example.com/",
+	}
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("metadata = %+v, want %+v", meta, want)
+	}
+
+	// Without a base url or description
+	conf.BaseURL = ""
+	meta = FeedMetadata(conf, "news", FeedConfig{}, &gofeed.Feed{Title: "Example"})
+	want = Metadata{"nick": "news", "description": "Example"}
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("metadata = %+v, want %+v", meta, want)
+	}
+}
+
+func TestWriteMetadata(t *testing.T) {
+	fn := filepath.Join(tempDir(t), "news.txt")
+
+	meta := Metadata{
+		"nick":        "news",
+		"url":         "https://feeds.example.com/news/twtxt.txt",
+		"avatar":      "https://feeds.example.com/news/avatar.png",
+		"description": "All the news",
+	}
+
+	// New feeds get just the header
+	if err := WriteMetadata(fn, meta); err != nil {
+		t.Fatal(err)
+	}
+	header := `# nick = news
+# url = https://feeds.example.com/news/twtxt.txt
+# avatar = https://feeds.example.com/news/avatar.png
+# description = All the news
+#
+`
+	if data := readHistory(t, fn); data != header {
+		t.Errorf("header =\n%s\nwant\n%s", data, header)
+	}
+
+	// Rewriting the header keeps the twts and the archive link
+	twts := "2023-11-14T22:13:20Z\tOne\n2023-11-14T23:13:20Z\tTwo\n"
+	old := `# nick = old
+# description = Old news
+# prev = abcdefg twtxt.txt.1700000000
+#
+`
+	if err := ioutil.WriteFile(fn, []byte(old+twts), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	meta["description"] = "All the news, updated"
+	if err := WriteMetadata(fn, meta); err != nil {
+		t.Fatal(err)
+	}
+	want := `# nick = news
+# url = https://feeds.example.com/news/twtxt.txt
+# avatar = https://feeds.example.com/news/avatar.png
+# description = All the news, updated
+# prev = abcdefg twtxt.txt.1700000000
+#
+` + twts
+	if data := readHistory(t, fn); data != want {
+		t.Errorf("feed =\n%s\nwant\n%s", data, want)
+	}
+
+	// An unchanged header isn't rewritten
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(fn, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMetadata(fn, meta); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.ModTime().Equal(mtime) {
+		t.Error("unchanged header was rewritten")
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-yaml/yaml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// reloadDelay is how long to wait for writes to the config file to
+	// settle before reloading it
+	reloadDelay = time.Second
+)
+
+// FeedsDiff lists the feeds that changed between two configurations
+type FeedsDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// Empty reports whether no feeds changed
+func (diff FeedsDiff) Empty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Changed) == 0
+}
+
+// DiffFeeds compares two sets of feeds
+func DiffFeeds(old, new map[string]FeedConfig) FeedsDiff {
+	var diff FeedsDiff
+
+	for name, feed := range new {
+		prev, ok := old[name]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, name)
+		case prev != feed:
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+
+	return diff
+}
+
+// ErrRestartRequired is returned when reloading a config file that changes
+// settings which are only applied on restart
+var ErrRestartRequired = errors.New("error: settings other than feeds, template, polling, moderation and auth changed, restart to apply them")
+
+// setReloadable replaces the feeds, the moderation queue, redirects and
+// tombstones as well as the settings applied on reload with the ones of from
+func (conf *Config) setReloadable(from *Config) {
+	conf.Feeds = from.Feeds
+	conf.Pending = from.Pending
+	conf.Redirects = from.Redirects
+	conf.Tombstones = from.Tombstones
+	conf.Template = from.Template
+	conf.PollConfig = from.PollConfig
+	conf.Moderate = from.Moderate
+	conf.Auth = from.Auth
+}
+
+// restartSettings returns the configuration without the feeds and the
+// settings applied on reload, used to detect changes to settings that can
+// only be applied on restart
+func (conf *Config) restartSettings() ([]byte, error) {
+	conf.mu.RLock()
+	copy := *conf
+	conf.mu.RUnlock()
+
+	copy.setReloadable(&Config{})
+	return yaml.Marshal(&copy)
+}
+
+// mergeFeeds applies the feeds added, changed and removed between base and
+// theirs to ours
+func mergeFeeds(ours, base, theirs map[string]FeedConfig) {
+	for name, feed := range theirs {
+		if prev, ok := base[name]; !ok || prev != feed {
+			ours[name] = feed
+		}
+	}
+	for name := range base {
+		if _, ok := theirs[name]; !ok {
+			delete(ours, name)
+		}
+	}
+}
+
+// mergeRedirects applies the redirects added, changed and removed between
+// base and theirs to ours
+func mergeRedirects(ours, base, theirs map[string]string) {
+	for from, to := range theirs {
+		if prev, ok := base[from]; !ok || prev != to {
+			ours[from] = to
+		}
+	}
+	for from := range base {
+		if _, ok := theirs[from]; !ok {
+			delete(ours, from)
+		}
+	}
+}
+
+// mergeTombstones applies the tombstones added, changed and removed between
+// base and theirs to ours
+func mergeTombstones(ours, base, theirs map[string]time.Time) {
+	for name, ended := range theirs {
+		if prev, ok := base[name]; !ok || !prev.Equal(ended) {
+			ours[name] = ended
+		}
+	}
+	for name := range base {
+		if _, ok := theirs[name]; !ok {
+			delete(ours, name)
+		}
+	}
+}
+
+// merge applies the changes made to the config file since it was last read
+// or written, as found in latest, to the feeds, the moderation queue,
+// redirects and tombstones, and replaces the settings applied on reload
+// with the ones from latest. It returns the feeds that changed and whether
+// the polling settings changed. The caller must hold .saveMu.
+func (conf *Config) merge(latest *Config) (FeedsDiff, bool, error) {
+	base := NewConfig()
+	if len(conf.saved) > 0 {
+		var err error
+		if base, err = parseConfig(conf.saved, conf.path); err != nil {
+			return FeedsDiff{}, false, err
+		}
+	}
+
+	conf.mu.Lock()
+	defer conf.mu.Unlock()
+
+	feeds := copyFeeds(conf.Feeds)
+	mergeFeeds(conf.Feeds, base.Feeds, latest.Feeds)
+	mergeFeeds(conf.Pending, base.Pending, latest.Pending)
+	mergeRedirects(conf.Redirects, base.Redirects, latest.Redirects)
+	mergeTombstones(conf.Tombstones, base.Tombstones, latest.Tombstones)
+
+	pollChanged := conf.PollConfig != latest.PollConfig
+	conf.Template = latest.Template
+	conf.PollConfig = latest.PollConfig
+	conf.Moderate = latest.Moderate
+	conf.Auth = latest.Auth
+
+	return DiffFeeds(feeds, conf.Feeds), pollChanged, nil
+}
+
+// mergeFile merges the changes made to the config file by other processes
+// before it is written and returns the config in the file, or nil if there
+// is none. An invalid file is an error so that it is fixed by hand rather
+// than overwritten. The caller must hold .saveMu and the config lock.
+func (conf *Config) mergeFile() (*Config, FeedsDiff, error) {
+	data, err := ioutil.ReadFile(conf.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, FeedsDiff{}, nil
+		}
+		return nil, FeedsDiff{}, err
+	}
+
+	latest, err := parseConfig(data, conf.path)
+	if err != nil {
+		return nil, FeedsDiff{}, fmt.Errorf("error parsing config file %s: %w", conf.path, err)
+	}
+
+	if bytes.Equal(data, conf.saved) {
+		return latest, FeedsDiff{}, nil
+	}
+
+	diff, _, err := conf.merge(latest)
+	if err != nil {
+		return nil, FeedsDiff{}, err
+	}
+	return latest, diff, nil
+}
+
+// updateIndex adds the feeds added to the config file by other processes
+// to the index and removes the ones they removed
+func (conf *Config) updateIndex(diff FeedsDiff) {
+	for _, name := range diff.Removed {
+		conf.Index().Remove(name)
+	}
+	for _, name := range diff.Added {
+		conf.Index().Refresh(conf, name)
+	}
+}
+
+// removedFromFile reports whether the named feed was removed from the
+// config file by another process since it was last read or written
+func (conf *Config) removedFromFile(name string) bool {
+	data, err := ioutil.ReadFile(conf.path)
+	if err != nil {
+		return false
+	}
+
+	conf.saveMu.Lock()
+	saved := bytes.Equal(data, conf.saved)
+	conf.saveMu.Unlock()
+	if saved {
+		return false
+	}
+
+	latest, err := parseConfig(data, conf.path)
+	if err != nil {
+		return false
+	}
+	_, ok := latest.Feeds[name]
+	return !ok
+}
+
+// Reload reads the config file again and, if it is valid, applies the
+// feeds, the moderation queue, redirects and tombstones added, changed or
+// removed in the file and replaces the default template, polling settings,
+// moderation and auth with the ones from the file. Files changing other
+// settings are rejected with ErrRestartRequired. Feeds whose config
+// changed, or all feeds if the polling settings changed, are rescheduled to
+// be polled on the next run.
+func (conf *Config) Reload() (FeedsDiff, error) {
+	diff, reschedule, err := conf.reload()
+	if err != nil {
+		return FeedsDiff{}, err
+	}
+
+	conf.updateIndex(diff)
+	for _, name := range reschedule {
+		if err := rescheduleFeed(conf, name); err != nil {
+			log.WithError(err).Warnf("error rescheduling feed %s", name)
+		}
+	}
+
+	// Discard the schedules cached before the feeds were rescheduled
+	if len(reschedule) > 0 {
+		conf.mu.Lock()
+		conf.reloads++
+		conf.mu.Unlock()
+	}
+
+	return diff, nil
+}
+
+// reload merges the config file while holding the config lock and returns
+// the feeds that changed and the ones to reschedule
+func (conf *Config) reload() (FeedsDiff, []string, error) {
+	conf.saveMu.Lock()
+	defer conf.saveMu.Unlock()
+
+	unlock, err := lockFile(conf.configLock())
+	if err != nil {
+		return FeedsDiff{}, nil, err
+	}
+	defer unlock()
+
+	data, err := ioutil.ReadFile(conf.path)
+	if err != nil {
+		return FeedsDiff{}, nil, err
+	}
+	if bytes.Equal(data, conf.saved) {
+		// Written by .Save(), nothing to apply
+		return FeedsDiff{}, nil, nil
+	}
+
+	latest, err := parseConfig(data, conf.path)
+	if err != nil {
+		return FeedsDiff{}, nil, err
+	}
+
+	current, err := conf.restartSettings()
+	if err != nil {
+		return FeedsDiff{}, nil, err
+	}
+	updated, err := latest.restartSettings()
+	if err != nil {
+		return FeedsDiff{}, nil, err
+	}
+	if !bytes.Equal(current, updated) {
+		return FeedsDiff{}, nil, ErrRestartRequired
+	}
+
+	diff, pollChanged, err := conf.merge(latest)
+	if err != nil {
+		return FeedsDiff{}, nil, err
+	}
+	conf.saved = data
+
+	reschedule := diff.Changed
+	if pollChanged {
+		reschedule = nil
+		for name := range conf.AllFeeds() {
+			reschedule = append(reschedule, name)
+		}
+	}
+
+	return diff, reschedule, nil
+}
+
+// rescheduleFeed schedules the named feed to be polled immediately so that
+// changes to its interval take effect
+func rescheduleFeed(conf *Config, name string) error {
+	unlock := conf.LockFeed(name)
+	defer unlock()
+
+	state, err := LoadState(conf, name)
+	if err != nil {
+		return err
+	}
+
+	state.NextPoll = time.Time{}
+	return state.Save()
+}
+
+// reloadConfig reloads the config and logs the feeds that changed
+func (app *App) reloadConfig() {
+	diff, err := app.conf.Reload()
+	if err != nil {
+		log.WithError(err).Error("error reloading config, keeping the current one")
+		return
+	}
+
+	if diff.Empty() {
+		log.Debug("reloaded config, no feeds changed")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"added":   diff.Added,
+		"removed": diff.Removed,
+		"changed": diff.Changed,
+	}).Info("reloaded config")
+}
+
+// handleReloads reloads the config on SIGHUP and, if enabled, whenever the
+// config file changes
+func (app *App) handleReloads() error {
+	reload := make(chan struct{}, 1)
+	trigger := func() {
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info("received SIGHUP, reloading config")
+			trigger()
+		}
+	}()
+
+	if app.conf.Watch {
+		if err := app.watchConfig(trigger); err != nil {
+			signal.Stop(hup)
+			return err
+		}
+	}
+
+	go func() {
+		for range reload {
+			app.reloadConfig()
+		}
+	}()
+
+	return nil
+}
+
+// watchConfig calls trigger after the config file changes. The directory
+// is watched rather than the file as editors usually replace the file.
+func (app *App) watchConfig(trigger func()) error {
+	path, err := filepath.Abs(app.conf.path)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(reloadDelay, trigger)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.WithError(err).Warn("error watching config file")
+			}
+		}
+	}()
+
+	log.Infof("watching %s for changes", path)
+
+	return nil
+}
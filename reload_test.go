@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffFeeds(t *testing.T) {
+	old := map[string]FeedConfig{
+		"same":    {URL: "https://example.com/same.xml"},
+		"changed": {URL: "https://example.com/changed.xml"},
+		"removed": {URL: "https://example.com/removed.xml"},
+		"renick":  {URL: "https://example.com/renick.xml"},
+	}
+	new := map[string]FeedConfig{
+		"same":    {URL: "https://example.com/same.xml"},
+		"changed": {URL: "https://example.com/changed.xml", Interval: time.Hour},
+		"renick":  {URL: "https://example.com/renick.xml", Nick: "Renick"},
+		"b-added": {URL: "https://example.com/b.xml"},
+		"a-added": {URL: "https://example.com/a.xml"},
+	}
+
+	diff := DiffFeeds(old, new)
+
+	want := FeedsDiff{
+		Added:   []string{"a-added", "b-added"},
+		Removed: []string{"removed"},
+		Changed: []string{"changed", "renick"},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("diff = %+v, want %+v", diff, want)
+	}
+
+	if !DiffFeeds(old, old).Empty() {
+		t.Error("diff of identical feeds is not empty")
+	}
+}
+
+func TestReload(t *testing.T) {
+	root := tempDir(t)
+	base := "root: " + root + "\nfeeds:\n  a: https://example.com/a.xml\n  b:\n    url: https://example.com/b.xml\n    interval: 1h\n"
+
+	fn := writeConfig(t, base)
+	conf, err := LoadConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := LoadState(conf, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.NextPoll = time.Now().Add(time.Hour)
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Settings applied on reload
+	updated := base + `  c: https://example.com/c.xml
+interval: 10m
+disableafter: 24h
+template: "{{ .Title }}"
+moderate: true
+auth:
+  tokens:
+    admin:
+      token: secret
+      role: admin
+`
+	if err := ioutil.WriteFile(fn, []byte(updated), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := conf.Reload()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := (FeedsDiff{Added: []string{"c"}}); !reflect.DeepEqual(diff, want) {
+		t.Errorf("diff = %+v, want %+v", diff, want)
+	}
+
+	if poll := conf.Polling(); poll.Interval != 10*time.Minute || poll.DisableAfter != 24*time.Hour {
+		t.Errorf("polling settings were not applied: %+v", poll)
+	}
+	if conf.TwtTemplate(FeedConfig{}) != "{{ .Title }}" {
+		t.Error("template was not applied")
+	}
+	if !conf.IsModerated() || conf.GetAuth().Tokens["admin"].Token != "secret" {
+		t.Error("moderation and auth were not applied")
+	}
+
+	// All feeds are rescheduled when the polling settings change
+	if conf.Reloads() == 0 {
+		t.Error("cached schedules were not discarded")
+	}
+	if state, err = LoadState(conf, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if !state.NextPoll.IsZero() {
+		t.Errorf("feed was not rescheduled, next poll %s", state.NextPoll)
+	}
+
+	// Revoking a token takes effect
+	revoked := strings.Replace(updated, "token: secret", "token: changed", 1)
+	if err := ioutil.WriteFile(fn, []byte(revoked), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conf.Reload(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if token := conf.GetAuth().Tokens["admin"].Token; token != "changed" {
+		t.Errorf("token = %s, want the changed one", token)
+	}
+
+	// Settings only applied on restart reject the whole file
+	rejected := strings.Replace(revoked, "  c: https://example.com/c.xml\n", "", 1) + "workers: 8\nhttp:\n  deny: [\"203.0.113.0/24\"]\n"
+	if err := ioutil.WriteFile(fn, []byte(rejected), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conf.Reload(); err != ErrRestartRequired {
+		t.Fatalf("expected ErrRestartRequired, got %v", err)
+	}
+	if !conf.HasFeed("c") || conf.Workers != defaultWorkers {
+		t.Error("rejected config was partially applied")
+	}
+}
+
+func TestSaveMergesFile(t *testing.T) {
+	root := tempDir(t)
+	fn := writeConfig(t, "root: "+root+"\nfeeds:\n  a: https://example.com/a.xml\n  b: https://example.com/b.xml\n")
+
+	// A running server and the cli using the same config file
+	server, err := LoadConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := LoadConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cli.AddFeed("c", FeedConfig{URL: "https://example.com/c.xml"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteFeed(cli, "a", DeleteOptions{}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server stops updating feeds removed by the cli before reloading
+	if err := UpdateFeed(server, "a", FeedConfig{URL: "https://example.com/a.xml"}); err != ErrFeedNotFound {
+		t.Errorf("expected ErrFeedNotFound, got %v", err)
+	}
+
+	// Settings only applied on restart edited by hand are kept
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, append(data, "workers: 8\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.AddFeed("d", FeedConfig{URL: "https://example.com/d.xml"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, conf := range []*Config{server, mustLoadConfig(t, fn)} {
+		var names []string
+		for name := range conf.AllFeeds() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if want := []string{"b", "c", "d"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("feeds = %v, want %v", names, want)
+		}
+	}
+	if conf := mustLoadConfig(t, fn); conf.Workers != 8 {
+		t.Errorf("workers = %d, want the ones from the file", conf.Workers)
+	}
+	if server.Workers != defaultWorkers {
+		t.Error("setting only applied on restart was applied")
+	}
+}
+
+func TestSaveKeepsInvalidFile(t *testing.T) {
+	root := tempDir(t)
+	fn := writeConfig(t, "root: "+root+"\nfeeds:\n  a: https://example.com/a.xml\n")
+
+	conf, err := LoadConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A broken edit made by hand while the server is running
+	invalid := []byte("root: " + root + "\nfeeds: [\n")
+	if err := ioutil.WriteFile(fn, invalid, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conf.AddFeed("b", FeedConfig{URL: "https://example.com/b.xml"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Save(); err == nil {
+		t.Error("expected an error saving over an invalid config file")
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, invalid) {
+		t.Errorf("invalid config file overwritten with %q", data)
+	}
+}
+
+func mustLoadConfig(t *testing.T, fn string) *Config {
+	conf, err := LoadConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
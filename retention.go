@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// archivePattern matches archived segments name.txt.<n> and name.txt.<n>.gz
+	archivePattern = regexp.MustCompile(`^(.+)\.txt\.([0-9]+)(\.gz)?$`)
+)
+
+// RetentionConfig limits the archived segments kept for each feed. Limits
+// that are zero are not enforced.
+type RetentionConfig struct {
+	MaxArchives int           `yaml:",omitempty"` // maximum number of archives kept per feed
+	MaxAge      time.Duration `yaml:",omitempty"` // archives older than this are deleted
+	MaxBytes    int64         `yaml:",omitempty"` // maximum total size of the archives of a feed
+	Compress    bool          `yaml:",omitempty"` // gzip archived segments
+}
+
+// Validate checks that no limit is negative
+func (conf RetentionConfig) Validate() error {
+	if conf.MaxArchives < 0 {
+		return fmt.Errorf("error: retention maxarchives must not be negative")
+	}
+	if conf.MaxAge < 0 {
+		return fmt.Errorf("error: retention maxage must not be negative")
+	}
+	if conf.MaxBytes < 0 {
+		return fmt.Errorf("error: retention maxbytes must not be negative")
+	}
+	return nil
+}
+
+// Archive is an archived segment of a feed
+type Archive struct {
+	Name       string // name of the feed
+	N          int64  // unix time the segment was archived at
+	Path       string
+	Size       int64
+	Compressed bool
+}
+
+// Created returns when the segment was archived
+func (archive Archive) Created() time.Time {
+	return time.Unix(archive.N, 0)
+}
+
+// Archives returns the archived segments of all feeds in root grouped by
+// feed name, newest first
+func Archives(root string) (map[string][]Archive, error) {
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	archives := make(map[string][]Archive)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		match := archivePattern.FindStringSubmatch(file.Name())
+		if match == nil {
+			continue
+		}
+
+		n, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		name := match[1]
+		archives[name] = append(archives[name], Archive{
+			Name:       name,
+			N:          n,
+			Path:       filepath.Join(root, file.Name()),
+			Size:       file.Size(),
+			Compressed: match[3] != "",
+		})
+	}
+
+	for _, list := range archives {
+		sort.Slice(list, func(i, j int) bool { return list[i].N > list[j].N })
+	}
+
+	return archives, nil
+}
+
+// CompressArchive gzips an archived segment replacing the original file
+func CompressArchive(archive Archive) (Archive, error) {
+	f, err := os.Open(archive.Path)
+	if err != nil {
+		return archive, err
+	}
+	defer f.Close()
+
+	fn := archive.Path + ".gz"
+	tf, err := ioutil.TempFile(filepath.Dir(fn), fmt.Sprintf(".%s-*", filepath.Base(fn)))
+	if err != nil {
+		return archive, err
+	}
+	defer os.Remove(tf.Name())
+
+	zw := gzip.NewWriter(tf)
+	if _, err := io.Copy(zw, f); err != nil {
+		tf.Close()
+		return archive, err
+	}
+	if err := zw.Close(); err != nil {
+		tf.Close()
+		return archive, err
+	}
+	if err := tf.Close(); err != nil {
+		return archive, err
+	}
+
+	stat, err := os.Stat(tf.Name())
+	if err != nil {
+		return archive, err
+	}
+
+	if err := os.Chmod(tf.Name(), 0644); err != nil {
+		return archive, err
+	}
+	if err := os.Rename(tf.Name(), fn); err != nil {
+		return archive, err
+	}
+	if err := os.Remove(archive.Path); err != nil {
+		return archive, err
+	}
+
+	archive.Path = fn
+	archive.Size = stat.Size()
+	archive.Compressed = true
+	return archive, nil
+}
+
+// PruneArchives enforces the retention policy on the archives of the named
+// feed. The `# prev` link to the expired archives is removed from the oldest
+// remaining archive, or from the feed itself if none remain, before they are
+// deleted so that clients following the history never end up at a missing
+// segment.
+func PruneArchives(conf *Config, name string, now time.Time) error {
+	unlock := conf.LockFeed(name)
+	defer unlock()
+
+	// List the archives while holding the lock so that a rotation can't
+	// add a segment linking to the ones being deleted
+	archives, err := Archives(conf.Root)
+	if err != nil {
+		return err
+	}
+
+	kept, expired := ExpiredArchives(conf.Retention, archives[name], now)
+	if len(expired) == 0 {
+		return nil
+	}
+
+	if len(kept) > 0 {
+		err = unlinkArchive(kept[len(kept)-1])
+	} else {
+		err = unlinkFeed(feedFile(conf, name, "txt"))
+	}
+	if err != nil {
+		return fmt.Errorf("error removing link to expired archives: %w", err)
+	}
+
+	for _, archive := range expired {
+		if err := os.Remove(archive.Path); err != nil {
+			return err
+		}
+		log.Infof(
+			"deleted archive %s of %s from %s",
+			filepath.Base(archive.Path), archive.Name, humanize.Time(archive.Created()),
+		)
+	}
+
+	return nil
+}
+
+// ExpiredArchives returns the archives of a feed within the retention
+// limits and the ones exceeding them, compressing the former if enabled.
+// archives must be sorted newest first, once an archive exceeds a limit all
+// older ones are expired too so that the remaining history is contiguous.
+func ExpiredArchives(conf RetentionConfig, archives []Archive, now time.Time) ([]Archive, []Archive) {
+	var (
+		kept    []Archive
+		total   int64
+		expired bool
+	)
+
+	for i, archive := range archives {
+		expired = expired || (conf.MaxArchives > 0 && len(kept) >= conf.MaxArchives)
+		expired = expired || (conf.MaxAge > 0 && now.Sub(archive.Created()) > conf.MaxAge)
+
+		if !expired && conf.Compress && !archive.Compressed {
+			compressed, err := CompressArchive(archive)
+			if err != nil {
+				log.WithError(err).Errorf("error compressing archive %s", archive.Path)
+			} else {
+				archive = compressed
+			}
+		}
+
+		expired = expired || (conf.MaxBytes > 0 && total+archive.Size > conf.MaxBytes)
+
+		if expired {
+			return kept, archives[i:]
+		}
+
+		kept = append(kept, archive)
+		total += archive.Size
+	}
+
+	return kept, nil
+}
+
+// unlinkFeed removes the `# prev` link from a feed file
+func unlinkFeed(fn string) error {
+	if !Exists(fn) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	if data, ok := removePrevLinks(data); ok {
+		return WriteFileAtomic(fn, data, 0644)
+	}
+	return nil
+}
+
+// unlinkArchive removes the `# prev` link from an archived segment,
+// recompressing it if it is compressed
+func unlinkArchive(archive Archive) error {
+	data, err := ioutil.ReadFile(archive.Path)
+	if err != nil {
+		return err
+	}
+
+	if archive.Compressed {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return err
+		}
+	}
+
+	data, ok := removePrevLinks(data)
+	if !ok {
+		return nil
+	}
+
+	if archive.Compressed {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	return WriteFileAtomic(archive.Path, data, 0644)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeArchives writes archived segments of the feed test of the given sizes
+// to root, one per hour before now with the first being the newest
+func writeArchives(t *testing.T, root string, now time.Time, sizes ...int) {
+	for i, size := range sizes {
+		n := now.Add(-time.Duration(i+1) * time.Hour).Unix()
+		fn := filepath.Join(root, fmt.Sprintf("test.txt.%d", n))
+		if err := ioutil.WriteFile(fn, []byte(strings.Repeat("x", size)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// keptArchives returns the hours before now of the archives left in root
+func keptArchives(t *testing.T, root string, now time.Time) []int {
+	archives, err := Archives(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hours []int
+	for _, archive := range archives["test"] {
+		hours = append(hours, int(now.Sub(archive.Created())/time.Hour))
+	}
+	return hours
+}
+
+func TestArchives(t *testing.T) {
+	root := tempDir(t)
+	for _, fn := range []string{"a.txt", "a.txt.100", "a.txt.300.gz", "a.txt.200", "b.txt.1", "a.txt.x", "a.png"} {
+		if err := ioutil.WriteFile(filepath.Join(root, fn), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archives, err := Archives(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archives) != 2 || len(archives["a"]) != 3 || len(archives["b"]) != 1 {
+		t.Fatalf("unexpected archives %+v", archives)
+	}
+	var ns []int64
+	for _, archive := range archives["a"] {
+		ns = append(ns, archive.N)
+	}
+	if want := []int64{300, 200, 100}; !reflect.DeepEqual(ns, want) {
+		t.Errorf("archives = %v, want %v", ns, want)
+	}
+	if !archives["a"][0].Compressed || archives["a"][1].Compressed {
+		t.Error("compressed archives were not detected")
+	}
+}
+
+func TestPruneArchives(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name  string
+		conf  RetentionConfig
+		sizes []int
+		kept  []int
+	}{
+		{"no limits", RetentionConfig{}, []int{10, 10, 10}, []int{1, 2, 3}},
+		{"max archives", RetentionConfig{MaxArchives: 2}, []int{10, 10, 10, 10}, []int{1, 2}},
+		{"max age", RetentionConfig{MaxAge: 150 * time.Minute}, []int{10, 10, 10, 10}, []int{1, 2}},
+		{"max bytes", RetentionConfig{MaxBytes: 25}, []int{10, 10, 10}, []int{1, 2}},
+		{"max bytes exact", RetentionConfig{MaxBytes: 30}, []int{10, 10, 10}, []int{1, 2, 3}},
+		// Once an archive is deleted all older ones are too, so that the
+		// prev links of the remaining archives stay contiguous
+		{"max bytes contiguous", RetentionConfig{MaxBytes: 25}, []int{10, 20, 5}, []int{1}},
+		{"newest too large", RetentionConfig{MaxBytes: 5}, []int{10, 1}, nil},
+		{"combined", RetentionConfig{MaxArchives: 3, MaxAge: 10 * time.Hour, MaxBytes: 100}, []int{50, 40, 20, 1}, []int{1, 2}},
+	}
+
+	for _, test := range tests {
+		conf := NewConfig()
+		conf.Root = tempDir(t)
+		conf.Retention = test.conf
+		writeArchives(t, conf.Root, now, test.sizes...)
+
+		if err := PruneArchives(conf, "test", now); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if kept := keptArchives(t, conf.Root, now); !reflect.DeepEqual(kept, test.kept) {
+			t.Errorf("%s: kept archives %v, want %v", test.name, kept, test.kept)
+		}
+	}
+}
+
+func TestPruneArchivesCompress(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	conf := NewConfig()
+	conf.Root = tempDir(t)
+	root := conf.Root
+
+	data := strings.Repeat("2024-01-01T00:00:00Z\tHello World!\n", 100)
+	writeArchives(t, root, now, 0, 0, 0)
+	archives, err := Archives(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, archive := range archives["test"] {
+		if err := ioutil.WriteFile(archive.Path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The limit on bytes applies to the compressed size
+	conf.Retention = RetentionConfig{Compress: true, MaxBytes: int64(len(data))}
+	if err := PruneArchives(conf, "test", now); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	archives, err = Archives(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives["test"]) != 3 {
+		t.Fatalf("kept %d archives, want 3", len(archives["test"]))
+	}
+	for _, archive := range archives["test"] {
+		if !archive.Compressed {
+			t.Errorf("archive %s was not compressed", archive.Path)
+			continue
+		}
+
+		f, err := os.Open(archive.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(zr)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != data {
+			t.Errorf("archive %s was corrupted", archive.Path)
+		}
+	}
+}
+
+// writeHistory writes the feed test and n archived segments, one per hour
+// before now, each linking to the next older one
+func writeHistory(t *testing.T, conf *Config, now time.Time, n int) {
+	archive := func(i int) int64 { return now.Add(-time.Duration(i) * time.Hour).Unix() }
+
+	for i := 0; i <= n; i++ {
+		var lines []string
+		lines = append(lines, "# nick = test")
+		if i < n {
+			lines = append(lines, fmt.Sprintf("# prev = abcdefg twtxt.txt.%d", archive(i+1)))
+		}
+		lines = append(lines, "#", fmt.Sprintf("2024-01-01T00:00:0%dZ\ttwt %d", i, i))
+
+		fn := feedFile(conf, "test", "txt")
+		if i > 0 {
+			fn = ArchiveFile(conf, "test", archive(i))
+		}
+		if err := ioutil.WriteFile(fn, joinLines(lines), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readHistory reads the contents of a feed file or archived segment
+func readHistory(t *testing.T, fn string) string {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.HasSuffix(fn, ".gz") {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return string(data)
+}
+
+func TestPruneArchivesUnlinks(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	for _, compress := range []bool{false, true} {
+		conf := NewConfig()
+		conf.Root = tempDir(t)
+		conf.Retention = RetentionConfig{MaxArchives: 2, Compress: compress}
+		writeHistory(t, conf, now, 4)
+
+		if err := PruneArchives(conf, "test", now); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		archives, err := Archives(conf.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := archives["test"]
+		if len(list) != 2 {
+			t.Fatalf("kept %d archives, want 2", len(list))
+		}
+
+		// The newer archive still links to the oldest remaining one
+		if data := readHistory(t, list[0].Path); !strings.Contains(data, fmt.Sprintf("twtxt.txt.%d\n", list[1].N)) {
+			t.Errorf("link to the remaining archive was removed:\n%s", data)
+		}
+
+		// which no longer links to the deleted ones
+		data := readHistory(t, list[1].Path)
+		if strings.Contains(data, "# prev") {
+			t.Errorf("oldest archive links to a deleted archive:\n%s", data)
+		}
+		if !strings.Contains(data, "# nick = test\n#\n") || !strings.Contains(data, "twt 2") {
+			t.Errorf("oldest archive was corrupted:\n%s", data)
+		}
+
+		if data := readHistory(t, feedFile(conf, "test", "txt")); !strings.Contains(data, "# prev") {
+			t.Errorf("link from the feed was removed:\n%s", data)
+		}
+	}
+}
+
+func TestPruneArchivesUnlinksFeed(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	conf := NewConfig()
+	conf.Root = tempDir(t)
+	conf.Retention = RetentionConfig{MaxAge: time.Minute}
+	writeHistory(t, conf, now, 2)
+
+	if err := PruneArchives(conf, "test", now); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if kept := keptArchives(t, conf.Root, now); len(kept) != 0 {
+		t.Errorf("kept archives %v, want none", kept)
+	}
+
+	data := readHistory(t, feedFile(conf, "test", "txt"))
+	if strings.Contains(data, "# prev") {
+		t.Errorf("feed links to a deleted archive:\n%s", data)
+	}
+	if !strings.Contains(data, "twt 0") {
+		t.Errorf("feed was corrupted:\n%s", data)
+	}
+}
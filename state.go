@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-yaml/yaml"
+	"github.com/mmcdole/gofeed"
+)
+
+const (
+	// seenExpiry is how long an item key is remembered after it was last
+	// seen in the upstream feed before it is pruned from the index.
+	seenExpiry = time.Hour * 24 * 30
+)
+
+// State holds persistent per-feed state (such as which upstream items have
+// already been emitted) that survives feed rotation and restarts.
+type State struct {
+	Seen map[string]time.Time // item key -> last seen in upstream feed
+
+	// Validators from the last successful fetch used for conditional requests
+	ETag         string `yaml:",omitempty"`
+	LastModified string `yaml:",omitempty"`
+
+	// Polling schedule
+	TTL      time.Duration `yaml:",omitempty"` // update interval advertised by the feed
+	NextPoll time.Time     `yaml:",omitempty"`
+
+	// Consecutive polls permanently redirected to the same url
+	RedirectURL string `yaml:",omitempty"`
+	Redirects   int    `yaml:",omitempty"`
+
+	Health Health
+
+	path string // path to state file that was loaded used by .Save()
+}
+
+// StateFile returns the path to the state file for the named feed
+func StateFile(conf *Config, name string) string {
+	return filepath.Join(conf.Root, fmt.Sprintf("%s.state", name))
+}
+
+func (state *State) Parse(data []byte) error {
+	return yaml.Unmarshal(data, state)
+}
+
+func (state *State) Save() error {
+	data, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(state.path, data, 0644)
+}
+
+// IsNew reports whether the given key has not been seen before
+func (state *State) IsNew(key string) bool {
+	_, ok := state.Seen[key]
+	return !ok
+}
+
+// MarkSeen records the given key as seen at the given time
+func (state *State) MarkSeen(key string, now time.Time) {
+	state.Seen[key] = now
+}
+
+// Prune removes keys that have not been seen since before the given time
+func (state *State) Prune(before time.Time) {
+	for key, lastSeen := range state.Seen {
+		if lastSeen.Before(before) {
+			delete(state.Seen, key)
+		}
+	}
+}
+
+// RecordRedirect records that the feed was permanently redirected to url,
+// or that it was not redirected if url is empty.
+func (state *State) RecordRedirect(url string) {
+	if url == "" || url != state.RedirectURL {
+		state.Redirects = 0
+	}
+	state.RedirectURL = url
+	if url != "" {
+		state.Redirects++
+	}
+}
+
+// Health records the outcome of recent polls of a feed
+type Health struct {
+	LastSuccess  time.Time `yaml:",omitempty"`
+	LastError    string    `yaml:",omitempty"`
+	LastErrorAt  time.Time `yaml:",omitempty"`
+	LastStatus   int       `yaml:",omitempty"` // last HTTP status code, zero if no response
+	Failures     int       `yaml:",omitempty"` // consecutive failed polls
+	FailingSince time.Time `yaml:",omitempty"` // first of the consecutive failed polls
+	ItemsEmitted int       `yaml:",omitempty"` // total twts written
+}
+
+// Record records the outcome of a poll
+func (health *Health) Record(err error, now time.Time) {
+	if err == nil {
+		health.LastSuccess = now
+		health.Failures = 0
+		health.FailingSince = time.Time{}
+		return
+	}
+
+	if herr, ok := err.(gofeed.HTTPError); ok {
+		health.LastStatus = herr.StatusCode
+	} else {
+		health.LastStatus = 0
+	}
+
+	health.LastError = err.Error()
+	health.LastErrorAt = now
+	if health.Failures == 0 {
+		health.FailingSince = now
+	}
+	health.Failures++
+}
+
+// Failing reports whether the feed has been failing for at least d
+func (health Health) Failing(d time.Duration, now time.Time) bool {
+	return health.Failures > 0 && now.Sub(health.FailingSince) >= d
+}
+
+// Schedule schedules the next poll after the feed's interval, backing off
+// exponentially after consecutive failures up to MaxBackoff. Failing feeds
+// are never polled more often than healthy ones, even if their interval is
+// longer than MaxBackoff.
+func (state *State) Schedule(conf *Config, feed FeedConfig, now time.Time) {
+	poll := conf.Polling()
+	interval := poll.PollInterval(feed, state.TTL)
+
+	backoff := interval
+	for i := 0; i < state.Health.Failures && backoff < poll.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > poll.MaxBackoff {
+		backoff = poll.MaxBackoff
+	}
+	if backoff > interval {
+		interval = backoff
+	}
+
+	state.NextPoll = now.Add(interval)
+}
+
+// ResetHealth clears the failure history of the named feed and schedules it
+// to be polled immediately, such as when a disabled feed is re-enabled.
+func ResetHealth(conf *Config, name string) error {
+	state, err := LoadState(conf, name)
+	if err != nil {
+		return err
+	}
+
+	state.Health.Failures = 0
+	state.Health.FailingSince = time.Time{}
+	state.NextPoll = time.Time{}
+
+	if err := state.Save(); err != nil {
+		return err
+	}
+
+	conf.Index().Refresh(conf, name)
+	return nil
+}
+
+// LoadState loads the state for the named feed, returning an empty state
+// if none has been saved yet.
+func LoadState(conf *Config, name string) (*State, error) {
+	state := &State{path: StateFile(conf, name)}
+
+	data, err := ioutil.ReadFile(state.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := state.Parse(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if state.Seen == nil {
+		state.Seen = make(map[string]time.Time)
+	}
+
+	return state, nil
+}
+
+// ItemKey returns a stable key identifying an upstream feed item using its
+// GUID, falling back to its link and finally a hash of its title, date and
+// content.
+func ItemKey(item *gofeed.Item) string {
+	if item.GUID != "" {
+		return fmt.Sprintf("guid:%s", item.GUID)
+	}
+
+	if item.Link != "" {
+		return fmt.Sprintf("link:%s", item.Link)
+	}
+
+	h := sha1.New()
+	h.Write([]byte(item.Title))
+	h.Write([]byte(item.Published))
+	h.Write([]byte(item.Description))
+	h.Write([]byte(item.Content))
+	return fmt.Sprintf("hash:%s", hex.EncodeToString(h.Sum(nil)))
+}
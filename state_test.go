@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestItemKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		item   *gofeed.Item
+		prefix string
+	}{
+		{"guid", &gofeed.Item{GUID: "1", Link: "https://example.com/1", Title: "One"}, "guid:1"},
+		{"link", &gofeed.Item{Link: "https://example.com/1", Title: "One"}, "link:https://example.com/1"},
+		{"hash", &gofeed.Item{Title: "One", Published: "Mon, 02 Jan 2006 15:04:05 GMT"}, "hash:"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if key := ItemKey(test.item); !strings.HasPrefix(key, test.prefix) {
+				t.Errorf("ItemKey = %s, want prefix %s", key, test.prefix)
+			}
+		})
+	}
+
+	// Without a GUID or link the title and date identify the item
+	item := &gofeed.Item{Title: "One", Published: "Mon, 02 Jan 2006 15:04:05 GMT"}
+	if ItemKey(item) != ItemKey(&gofeed.Item{Title: "One", Published: "Mon, 02 Jan 2006 15:04:05 GMT"}) {
+		t.Error("same item has different keys")
+	}
+	if ItemKey(item) == ItemKey(&gofeed.Item{Title: "One", Published: "Tue, 03 Jan 2006 15:04:05 GMT"}) {
+		t.Error("items published at different times have the same key")
+	}
+	if ItemKey(item) == ItemKey(&gofeed.Item{Title: "Two", Published: "Mon, 02 Jan 2006 15:04:05 GMT"}) {
+		t.Error("items with different titles have the same key")
+	}
+}
+
+func TestStatePrune(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	state := &State{Seen: make(map[string]time.Time)}
+	state.MarkSeen("old", now.Add(-seenExpiry-time.Hour))
+	state.MarkSeen("recent", now.Add(-time.Hour))
+
+	state.Prune(now.Add(-seenExpiry))
+
+	if !state.IsNew("old") {
+		t.Error("expired key was not pruned")
+	}
+	if state.IsNew("recent") {
+		t.Error("recent key was pruned")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	conf := NewConfig()
+	conf.Interval = 10 * time.Minute
+	conf.MaxBackoff = 2 * time.Hour
+	conf.HonorTTL = true
+
+	tests := []struct {
+		name     string
+		feed     FeedConfig
+		ttl      time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{"default", FeedConfig{}, 0, 0, 10 * time.Minute},
+		{"feed interval", FeedConfig{Interval: time.Hour}, 0, 0, time.Hour},
+		{"ttl", FeedConfig{}, 30 * time.Minute, 0, 30 * time.Minute},
+		{"ttl above max backoff", FeedConfig{}, 5 * time.Hour, 0, 2 * time.Hour},
+		{"one failure", FeedConfig{}, 0, 1, 20 * time.Minute},
+		{"three failures", FeedConfig{}, 0, 3, 80 * time.Minute},
+		{"capped backoff", FeedConfig{}, 0, 10, 2 * time.Hour},
+		{"feed interval above max backoff", FeedConfig{Interval: 6 * time.Hour}, 0, 0, 6 * time.Hour},
+		{"failing feed interval above max backoff", FeedConfig{Interval: 6 * time.Hour}, 0, 3, 6 * time.Hour},
+	}
+
+	for _, test := range tests {
+		state := &State{TTL: test.ttl}
+		state.Health.Failures = test.failures
+
+		state.Schedule(conf, test.feed, now)
+		if got := state.NextPoll.Sub(now); got != test.want {
+			t.Errorf("%s: next poll in %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -20,16 +20,16 @@ const indexTemplate = `
       <div>
         <hgroup>
           <h2>rss2twt 中文版</h2>
-          <footer>RSS/Atom 转换到 Twtxt Feed</footer>
+          <footer>RSS/Atom/JSON Feed 转换到 Twtxt Feed</footer>
         </hgroup>
         <p>
 		<b>注意：</b> 请添加 <b>中文</b> Feed 源，此站点主要为中文用户服务
 		<p>
 		</p>
-		rss2twt是一个命令行工具和Web应用程序，可以将 RSS/Atom Feed 转换为 <a href="https://twtxt.readthedocs.io/en/stable/index.html">Twtxt</a> Feed，以供 Twtxt 客户端（例如 <a href="https://www.twtxt.cc">twtxt.cc</a> 和 <a href="https://www.twtxt.net">twtxt.net</a>）使用。
+		rss2twt是一个命令行工具和Web应用程序，可以将 RSS/Atom/JSON Feed 转换为 <a href="https://twtxt.readthedocs.io/en/stable/index.html">Twtxt</a> Feed，以供 Twtxt 客户端（例如 <a href="https://www.twtxt.cc">twtxt.cc</a> 和 <a href="https://www.twtxt.net">twtxt.net</a>）使用。
         </p>
         <p>
-		您可以在这里任意添加新的 Feed 源，只需将网站的 URL 填入下面的文本输入框内，系统就会自动探索 RSS/Atom 源，如果 Feed 源有效，则将其添加到 <a href="/feeds">Feeds</a> 列表中。
+		您可以在这里任意添加新的 Feed 源，只需将网站的 URL 填入下面的文本输入框内，系统就会自动探索 RSS/Atom/JSON Feed 源，如果 Feed 源有效，则将其添加到 <a href="/feeds">Feeds</a> 列表中。
         </p>
         <p>
 		您可以使用自己喜欢的 <i>Twtxt</i> 客户端订阅 <a href="/feeds">Feed 源</a>（<i>我个人喜欢使用 <a href="https://github.com/quite/twet">twet</a></i>）。
@@ -80,7 +80,14 @@ const feedsTemplate = `
         {{ if .Feeds }}
           <ul>
             {{ range .Feeds }}
-              <li><a href="{{ .URL }}">{{ .Name }}</a>&nbsp;<small>({{ .LastModified }})</small></li>
+              <li>
+                <a href="{{ .URL }}">{{ .Name }}</a>&nbsp;<small>({{ .Twts }} 条, {{ .LastModified }})</small>
+                {{ if .Disabled }}
+                  <small>已停用</small>
+                {{ else if .Failures }}
+                  <small>连续 {{ .Failures }} 次更新失败</small>
+                {{ end }}
+              </li>
             {{ end }}
           </ul>
         {{ else }}
@@ -101,6 +108,115 @@ const feedsTemplate = `
 </html>
 `
 
+const pendingTemplate = `
+<!DOCTYPE html>
+<html lang="zh">
+  <head>
+    <link rel="stylesheet" href="https://unpkg.com/@picocss/pico@latest/css/pico.min.css">
+    <meta name="viewport" content="width=device-width, initial-scale=1" />
+    <title>rss2twt :: {{ .Title }}</title>
+  </head>
+<body>
+  <nav class="container-fluid">
+    <ul>
+      <li><strong><a href="/">rss2twt 中文版</a></strong></li>
+      <li><a href="/feeds">Feeds</a></li>
+    </ul>
+  </nav>
+  <main class="container">
+    <article class="grid">
+      <div>
+        <hgroup>
+          <h2>审核</h2>
+          <footer>待审核的 Feed 源</footer>
+        </hgroup>
+        {{ if .Feeds }}
+          <table>
+            {{ range .Feeds }}
+              <tr>
+                <td><a href="{{ .URL }}">{{ .Name }}</a></td>
+                <td>
+                  <form action="/admin/pending/{{ .Name }}/approve" method="POST">
+                    <button type="submit">批准</button>
+                  </form>
+                </td>
+                <td>
+                  <form action="/admin/pending/{{ .Name }}/reject" method="POST">
+                    <button type="submit" class="secondary">拒绝</button>
+                  </form>
+                </td>
+              </tr>
+            {{ end }}
+          </table>
+        {{ else }}
+          <small>没有待审核的 Feed 源</small>
+        {{ end }}
+      </div>
+    </article>
+  </main>
+  <footer class="container-fluid">
+    <hr>
+    <p>
+      <small>
+        Licensed under the <a href="https://github.com/twtpub/rss2twt/blob/master/LICENSE" class="secondary">MIT License</a><br>
+      </small>
+    </p>
+  </footer>
+</body>
+</html>
+`
+
+const chooseTemplate = `
+<!DOCTYPE html>
+<html lang="zh">
+  <head>
+    <link rel="stylesheet" href="https://unpkg.com/@picocss/pico@latest/css/pico.min.css">
+    <meta name="viewport" content="width=device-width, initial-scale=1" />
+    <title>rss2twt :: {{ .Title }}</title>
+  </head>
+<body>
+  <nav class="container-fluid">
+    <ul>
+      <li><strong><a href="/">rss2twt 中文版</a></strong></li>
+      <li><a href="/feeds">Feeds</a></li>
+    </ul>
+  </nav>
+  <main class="container">
+    <article class="grid">
+      <div>
+        <hgroup>
+          <h2>选择</h2>
+          <footer>{{ .URL }} 有多个 Feed 源，请选择一个</footer>
+        </hgroup>
+        <table>
+          {{ range .Candidates }}
+            <tr>
+              <td><a href="{{ .URL }}">{{ if .Title }}{{ .Title }}{{ else }}{{ .URL }}{{ end }}</a></td>
+              <td><small>{{ .Type }}</small></td>
+              <td>
+                <form action="/" method="POST">
+                  <input type="hidden" name="url" value="{{ .URL }}">
+                  <button type="submit">添加</button>
+                </form>
+              </td>
+            </tr>
+          {{ end }}
+        </table>
+      </div>
+    </article>
+  </main>
+  <footer class="container-fluid">
+    <hr>
+    <p>
+      <small>
+        Licensed under the <a href="https://github.com/twtpub/rss2twt/blob/master/LICENSE" class="secondary">MIT License</a><br>
+      </small>
+    </p>
+  </footer>
+</body>
+</html>
+`
+
 const messageTemplate = `
 <!DOCTYPE html>
 <html lang="zh">
@@ -1,13 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"image"
 	"image/png"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -29,11 +29,45 @@ var (
 	ErrInvalidName  = errors.New("error: invalid feed name")
 	ErrNameTooLong  = errors.New("error: name is too long")
 	ErrInvalidImage = errors.New("error: invalid image")
+
+	// ErrImageTooLarge is returned for images with more than
+	// maxImagePixels pixels, which could exhaust memory when decoded
+	ErrImageTooLarge = errors.New("error: image too large")
+)
+
+const (
+	// maxImagePixels is the largest number of pixels of images decoded
+	maxImagePixels = 4096 * 4096
 )
 
-func RotateFile(fn string) error {
-	now := time.Now().Unix()
-	return os.Rename(fn, fmt.Sprintf("%s.%d", fn, now))
+// WriteFileAtomic writes data to a temporary file in the same directory as
+// filename and renames it into place so readers never see a partial file
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tf, err := ioutil.TempFile(filepath.Dir(filename), fmt.Sprintf(".%s-*", filepath.Base(filename)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	if _, err := tf.Write(data); err != nil {
+		tf.Close()
+		return err
+	}
+
+	if err := tf.Sync(); err != nil {
+		tf.Close()
+		return err
+	}
+
+	if err := tf.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tf.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tf.Name(), filename)
 }
 
 func Exists(name string) bool {
@@ -73,7 +107,7 @@ type ImageOptions struct {
 }
 
 func DownloadImage(conf *Config, url string, filename string, opts *ImageOptions) error {
-	res, err := http.Get(url)
+	res, err := Get(conf, url)
 	if err != nil {
 		log.WithError(err).Errorf("error downloading image from %s", url)
 		return err
@@ -85,9 +119,10 @@ func DownloadImage(conf *Config, url string, filename string, opts *ImageOptions
 		log.WithError(err).Error("error creating temporary file")
 		return err
 	}
+	defer os.Remove(tf.Name())
 	defer tf.Close()
 
-	if _, err := io.Copy(tf, res.Body); err != nil {
+	if _, err := io.Copy(tf, LimitReader(res.Body, conf.HTTP.MaxImageSize)); err != nil {
 		log.WithError(err).Error("error writng temporary file")
 		return err
 	}
@@ -106,6 +141,17 @@ func DownloadImage(conf *Config, url string, filename string, opts *ImageOptions
 		return err
 	}
 
+	// Check the dimensions before decoding as a small image can claim to
+	// be huge
+	config, _, err := image.DecodeConfig(tf)
+	if err != nil {
+		log.WithError(err).Error("error decoding image header")
+		return err
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return ErrImageTooLarge
+	}
+
 	if _, err := tf.Seek(0, io.SeekStart); err != nil {
 		log.WithError(err).Error("error seeking temporary file")
 		return err
@@ -125,18 +171,15 @@ func DownloadImage(conf *Config, url string, filename string, opts *ImageOptions
 		}
 	}
 
-	fn := filepath.Join(conf.Root, filename)
-
-	of, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		log.WithError(err).Error("error opening output file")
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, newImg); err != nil {
+		log.WithError(err).Error("error reencoding image")
 		return err
 	}
-	defer of.Close()
 
-	// Encode uses a Writer, use a Buffer if you need the raw []byte
-	if err := png.Encode(of, newImg); err != nil {
-		log.WithError(err).Error("error reencoding image")
+	fn := filepath.Join(conf.Root, filename)
+	if err := WriteFileAtomic(fn, buf.Bytes(), 0644); err != nil {
+		log.WithError(err).Error("error writing output file")
 		return err
 	}
 
@@ -179,30 +222,10 @@ func URLForFeed(conf *Config, name string) string {
 	)
 }
 
-func WalkMatch(root, pattern string) ([]string, error) {
-	var matches []string
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		if matched, err := filepath.Match(pattern, filepath.Base(path)); err != nil {
-			return err
-		} else if matched {
-			matches = append(matches, path)
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	return matches, nil
-}
-
-func BaseWithoutExt(filename string) string {
-	base := filepath.Base(filename)
-	ext := filepath.Ext(base)
-	return strings.TrimSuffix(base, ext)
+func URLForAvatar(conf *Config, name string) string {
+	return fmt.Sprintf(
+		"%s/%s/avatar.png",
+		strings.TrimSuffix(conf.BaseURL, "/"),
+		name,
+	)
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encodePNG encodes a blank image claiming the given dimensions
+func encodePNG(t *testing.T, width, height uint32) []byte {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the dimensions and checksum of the IHDR chunk
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[16:20], width)
+	binary.BigEndian.PutUint32(data[20:24], height)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestDownloadImage(t *testing.T) {
+	images := map[string][]byte{
+		"/avatar.png": encodePNG(t, 1, 1),
+		"/bomb.png":   encodePNG(t, 100000, 100000),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(images[r.URL.Path])
+	}))
+	defer server.Close()
+
+	// Temporary files are created in TMPDIR
+	tmp := tempDir(t)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	tests := []struct {
+		name    string
+		path    string
+		maxSize int64
+		err     error
+	}{
+		{"valid", "/avatar.png", 0, nil},
+		{"too many bytes", "/avatar.png", 16, ErrResponseTooLarge},
+		{"too many pixels", "/bomb.png", 0, ErrImageTooLarge},
+	}
+
+	for _, test := range tests {
+		conf := newLocalConfig()
+		conf.Root = tempDir(t)
+		conf.HTTP.MaxImageSize = test.maxSize
+
+		err := DownloadImage(conf, server.URL+test.path, "test.png", nil)
+		if err != test.err {
+			t.Errorf("%s: error = %v, want %v", test.name, err, test.err)
+		}
+		if written := Exists(filepath.Join(conf.Root, "test.png")); written != (test.err == nil) {
+			t.Errorf("%s: avatar written = %t", test.name, written)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(tmp, "rss2twtxt-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) > 0 {
+		t.Errorf("temporary files left behind: %v", files)
+	}
+}